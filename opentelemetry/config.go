@@ -0,0 +1,166 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package opentelemetry
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Configuration is a configuration for an OpenTelemetry reporter.
+type Configuration struct {
+	// HandlerPath if specified will be used instead of using the default
+	// HTTP handler path "/metrics". It is only consulted when PrometheusBridge
+	// is enabled.
+	HandlerPath string `yaml:"handlerPath"`
+
+	// ListenAddress if specified will be used instead of just registering the
+	// handler on the default HTTP serve mux without listening. It is only
+	// consulted when PrometheusBridge is enabled.
+	ListenAddress string `yaml:"listenAddress"`
+
+	// TimerType is the default OpenTelemetry instrument to use for Tally
+	// timers. Valid values are "histogram" (the default).
+	TimerType string `yaml:"timerType"`
+
+	// DefaultHistogramBuckets if specified will set the default histogram
+	// bucket boundaries to be used by the reporter.
+	DefaultHistogramBuckets []float64 `yaml:"defaultHistogramBuckets"`
+
+	// Endpoint is the OTLP collector endpoint, e.g. "otel-collector:4317".
+	Endpoint string `yaml:"endpoint"`
+
+	// Protocol selects the OTLP wire protocol. Valid values are "grpc"
+	// (the default) and "http/protobuf".
+	Protocol string `yaml:"protocol"`
+
+	// Headers are additional headers sent with every OTLP export request,
+	// commonly used for collector authentication.
+	Headers map[string]string `yaml:"headers"`
+
+	// Insecure disables TLS when dialing the OTLP endpoint.
+	Insecure bool `yaml:"insecure"`
+
+	// PushInterval is how often metrics are exported to the collector via
+	// the periodic reader. Defaults to 10s.
+	PushInterval time.Duration `yaml:"pushInterval"`
+
+	// Resource is a set of attributes describing the process emitting
+	// metrics (e.g. service.name, service.version); merged into the
+	// exported sdkresource.Resource.
+	Resource map[string]string `yaml:"resource"`
+
+	// PrometheusBridge additionally exposes the same OpenTelemetry
+	// MeterProvider at HandlerPath via the Prometheus exporter, so that
+	// users can migrate incrementally from scrape-based collection to
+	// OTLP push without running two separate tally reporters.
+	PrometheusBridge bool `yaml:"prometheusBridge"`
+
+	// OnError specifies what to do when an error occurs registering an
+	// instrument or serving the Prometheus bridge listener. Errors from
+	// exporting to the collector are not passed to it. By default the
+	// reporter panics.
+	OnError string `yaml:"onError"`
+}
+
+// ConfigurationOptions allows some error callbacks to be registered.
+type ConfigurationOptions struct {
+	OnError func(e error)
+}
+
+// NewReporter creates a new OpenTelemetry reporter from this configuration.
+func (c Configuration) NewReporter(
+	configOpts ConfigurationOptions,
+) (Reporter, error) {
+	if configOpts.OnError == nil {
+		switch c.OnError {
+		case "stderr":
+			configOpts.OnError = func(err error) {
+				fmt.Fprintf(os.Stderr, "tally opentelemetry reporter error: %v\n", err)
+			}
+		case "log":
+			configOpts.OnError = func(err error) {
+				log.Printf("tally opentelemetry reporter error: %v\n", err)
+			}
+		case "none":
+			configOpts.OnError = func(err error) {}
+		default:
+			configOpts.OnError = func(err error) {
+				panic(err)
+			}
+		}
+	}
+
+	var opts Options
+	opts.OnError = configOpts.OnError
+	opts.Endpoint = c.Endpoint
+	opts.Protocol = c.Protocol
+	opts.Headers = c.Headers
+	opts.Insecure = c.Insecure
+	opts.Resource = c.Resource
+	opts.PrometheusBridge = c.PrometheusBridge
+
+	opts.PushInterval = c.PushInterval
+	if opts.PushInterval <= 0 {
+		opts.PushInterval = 10 * time.Second
+	}
+
+	switch c.TimerType {
+	case "histogram", "":
+		opts.DefaultTimerType = HistogramTimerType
+	}
+
+	if len(c.DefaultHistogramBuckets) > 0 {
+		opts.DefaultHistogramBuckets = c.DefaultHistogramBuckets
+	}
+
+	reporter, err := NewReporter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.PrometheusBridge {
+		return reporter, nil
+	}
+
+	path := "/metrics"
+	if handlerPath := strings.TrimSpace(c.HandlerPath); handlerPath != "" {
+		path = handlerPath
+	}
+
+	if addr := strings.TrimSpace(c.ListenAddress); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(path, reporter.HTTPHandler())
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				configOpts.OnError(err)
+			}
+		}()
+	} else {
+		http.Handle(path, reporter.HTTPHandler())
+	}
+
+	return reporter, nil
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package opentelemetry implements a tally reporter that exports metrics
+// through the OpenTelemetry Go metrics SDK, as a sibling to the prometheus
+// package for users who want to publish to an OTLP collector instead of
+// (or in addition to) being scraped directly.
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+
+	tally "github.com/uber-go/tally"
+)
+
+// TimerType determines how a Tally timer is represented as an
+// OpenTelemetry instrument.
+type TimerType int
+
+const (
+	// HistogramTimerType reports timers as an OpenTelemetry Histogram.
+	HistogramTimerType TimerType = iota
+)
+
+// Options is a set of options for the OpenTelemetry reporter.
+type Options struct {
+	// Endpoint is the OTLP collector endpoint.
+	Endpoint string
+
+	// Protocol selects the OTLP wire protocol, "grpc" or "http/protobuf".
+	// Defaults to "grpc".
+	Protocol string
+
+	// Headers are additional headers sent with every export request.
+	Headers map[string]string
+
+	// Insecure disables TLS when dialing the OTLP endpoint.
+	Insecure bool
+
+	// PushInterval is how often the periodic reader exports to the
+	// collector.
+	PushInterval time.Duration
+
+	// Resource is merged into the sdkresource.Resource attached to every
+	// export.
+	Resource map[string]string
+
+	// PrometheusBridge additionally registers a Prometheus exporter
+	// against the same MeterProvider so the process can be scraped while
+	// OTLP export is rolled out.
+	PrometheusBridge bool
+
+	// DefaultTimerType is the default OpenTelemetry instrument used for
+	// Tally timers.
+	DefaultTimerType TimerType
+
+	// DefaultHistogramBuckets are the bucket boundaries used for timer
+	// and histogram instruments that don't specify their own.
+	DefaultHistogramBuckets []float64
+
+	// OnError is called for errors encountered registering instruments;
+	// errors from exporting to the collector are not passed to it. By
+	// default it panics.
+	OnError func(e error)
+}
+
+// Reporter is a tally.CachedStatsReporter that reports to OpenTelemetry.
+type Reporter interface {
+	tally.CachedStatsReporter
+
+	// HTTPHandler returns the Prometheus bridge handler. It is only
+	// meaningful when the reporter was constructed with
+	// Options.PrometheusBridge set.
+	HTTPHandler() http.Handler
+}
+
+type reporter struct {
+	opts      Options
+	provider  metric.MeterProvider
+	meter     metric.Meter
+	promHTTP  http.Handler
+	onError   func(e error)
+	counters  sync.Map // name+tags -> instrument.Int64Counter
+	gauges    sync.Map // name+tags -> *gaugeSink
+	timers    sync.Map // name+tags -> instrument.Float64Histogram
+	histogram sync.Map // name+tags -> instrument.Float64Histogram
+}
+
+// NewReporter constructs a new OpenTelemetry reporter, wiring an OTLP
+// exporter and MeterProvider with a PeriodicReader, and optionally a
+// Prometheus bridge exporter for incremental migration.
+func NewReporter(opts Options) (Reporter, error) {
+	if opts.OnError == nil {
+		opts.OnError = func(err error) { panic(err) }
+	}
+	if opts.PushInterval <= 0 {
+		opts.PushInterval = 10 * time.Second
+	}
+
+	ctx := context.Background()
+
+	exporter, err := newOTLPExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource(ctx, opts.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := []sdkmetric.Option{
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(
+			exporter,
+			sdkmetric.WithInterval(opts.PushInterval),
+		)),
+	}
+
+	var promHandler http.Handler
+	if opts.PrometheusBridge {
+		registry := promclient.NewRegistry()
+		promExporter, err := otelprom.New(otelprom.WithRegisterer(registry))
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, sdkmetric.WithReader(promExporter))
+		promHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	}
+
+	provider := sdkmetric.NewMeterProvider(readers...)
+
+	r := &reporter{
+		opts:     opts,
+		provider: provider,
+		meter:    provider.Meter("github.com/uber-go/tally/opentelemetry"),
+		promHTTP: promHandler,
+		onError:  opts.OnError,
+	}
+
+	return r, nil
+}
+
+func newOTLPExporter(ctx context.Context, opts Options) (sdkmetric.Exporter, error) {
+	switch opts.Protocol {
+	case "http/protobuf":
+		httpOpts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(opts.Endpoint),
+			otlpmetrichttp.WithHeaders(opts.Headers),
+		}
+		if opts.Insecure {
+			httpOpts = append(httpOpts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, httpOpts...)
+	case "grpc", "":
+		grpcOpts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(opts.Endpoint),
+			otlpmetricgrpc.WithHeaders(opts.Headers),
+		}
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, grpcOpts...)
+	default:
+		return nil, fmt.Errorf("opentelemetry: unknown protocol %q", opts.Protocol)
+	}
+}
+
+func newResource(ctx context.Context, attrs map[string]string) (*sdkresource.Resource, error) {
+	if len(attrs) == 0 {
+		return sdkresource.Default(), nil
+	}
+
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+
+	return sdkresource.Merge(sdkresource.Default(), sdkresource.NewSchemaless(kvs...))
+}
+
+// Capabilities returns the reporting capabilities of the reporter.
+func (r *reporter) Capabilities() tally.Capabilities {
+	return tally.CapableOf(true, true)
+}
+
+// Flush is a no-op: export is driven by the PeriodicReader on its own
+// interval.
+func (r *reporter) Flush() {}
+
+func (r *reporter) HTTPHandler() http.Handler {
+	return r.promHTTP
+}
+
+func (r *reporter) AllocateCounter(
+	name string, tags map[string]string,
+) tally.CachedCount {
+	key := cacheKey(name, tags)
+	if v, ok := r.counters.Load(key); ok {
+		return &cachedCounter{counter: v.(instrument.Int64Counter), attrs: tagsToAttributes(tags)}
+	}
+
+	counter, err := r.meter.Int64Counter(name)
+	if err != nil {
+		r.onError(err)
+		return &cachedCounter{}
+	}
+	r.counters.Store(key, counter)
+	return &cachedCounter{counter: counter, attrs: tagsToAttributes(tags)}
+}
+
+func (r *reporter) AllocateGauge(
+	name string, tags map[string]string,
+) tally.CachedGauge {
+	key := cacheKey(name, tags)
+	if v, ok := r.gauges.Load(key); ok {
+		return v.(*gaugeSink)
+	}
+
+	sink := newGaugeSink(tagsToAttributes(tags))
+	_, err := r.meter.Float64ObservableGauge(name, instrument.WithFloat64Callback(sink.callback))
+	if err != nil {
+		r.onError(err)
+	}
+	r.gauges.Store(key, sink)
+	return sink
+}
+
+func (r *reporter) AllocateTimer(
+	name string, tags map[string]string,
+) tally.CachedTimer {
+	key := cacheKey(name, tags)
+	if v, ok := r.timers.Load(key); ok {
+		return &cachedTimer{histogram: v.(instrument.Float64Histogram), attrs: tagsToAttributes(tags)}
+	}
+
+	histogram, err := r.meter.Float64Histogram(name,
+		instrument.WithExplicitBucketBoundaries(r.opts.DefaultHistogramBuckets...))
+	if err != nil {
+		r.onError(err)
+		return &cachedTimer{}
+	}
+	r.timers.Store(key, histogram)
+	return &cachedTimer{histogram: histogram, attrs: tagsToAttributes(tags)}
+}
+
+func (r *reporter) AllocateHistogram(
+	name string, tags map[string]string, buckets tally.Buckets,
+) tally.CachedHistogram {
+	key := cacheKey(name, tags)
+	bounds := r.opts.DefaultHistogramBuckets
+	if buckets != nil {
+		bounds = buckets.AsValues()
+	}
+
+	if v, ok := r.histogram.Load(key); ok {
+		return &cachedHistogram{histogram: v.(instrument.Float64Histogram), attrs: tagsToAttributes(tags)}
+	}
+
+	histogram, err := r.meter.Float64Histogram(name,
+		instrument.WithExplicitBucketBoundaries(bounds...))
+	if err != nil {
+		r.onError(err)
+		return &cachedHistogram{}
+	}
+	r.histogram.Store(key, histogram)
+	return &cachedHistogram{histogram: histogram, attrs: tagsToAttributes(tags)}
+}
+
+// cacheKey must be deterministic across calls for the same name/tags so
+// that AllocateCounter/AllocateGauge/AllocateTimer/AllocateHistogram
+// reuse a cached instrument instead of creating a duplicate one each
+// time map iteration happens to order tags differently.
+func cacheKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := name
+	for _, k := range keys {
+		key += "," + k + "=" + tags[k]
+	}
+	return key
+}
+
+func tagsToAttributes(tags map[string]string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return attrs
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCacheKeyDeterministic(t *testing.T) {
+	tags := map[string]string{"b": "2", "a": "1", "c": "3"}
+
+	want := cacheKey("requests", tags)
+	for i := 0; i < 10; i++ {
+		if got := cacheKey("requests", tags); got != want {
+			t.Fatalf("cacheKey(%q, %v) = %q, want %q (map iteration order must not affect the key)", "requests", tags, got, want)
+		}
+	}
+}
+
+func TestCacheKeyDistinguishesNameAndTags(t *testing.T) {
+	base := cacheKey("requests", map[string]string{"route": "/foo"})
+
+	cases := map[string]string{
+		"different name":  cacheKey("errors", map[string]string{"route": "/foo"}),
+		"different value": cacheKey("requests", map[string]string{"route": "/bar"}),
+		"different tag":   cacheKey("requests", map[string]string{"method": "/foo"}),
+		"extra tag":       cacheKey("requests", map[string]string{"route": "/foo", "method": "GET"}),
+	}
+
+	for name, got := range cases {
+		if got == base {
+			t.Errorf("%s: cacheKey collided with base key %q", name, base)
+		}
+	}
+}
+
+func TestNewOTLPExporterUnknownProtocol(t *testing.T) {
+	_, err := newOTLPExporter(context.Background(), Options{Protocol: "carrier-pigeon"})
+	if err == nil {
+		t.Fatal("newOTLPExporter returned nil error for an unknown protocol, want an error")
+	}
+}
+
+func TestNewOTLPExporterDispatchesOnProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+	}{
+		{name: "grpc explicit", protocol: "grpc"},
+		{name: "grpc default", protocol: ""},
+		{name: "http/protobuf", protocol: "http/protobuf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// otlpmetricgrpc.New/otlpmetrichttp.New don't dial by default
+			// (no WithBlock), so construction here doesn't require a
+			// reachable collector.
+			exp, err := newOTLPExporter(context.Background(), Options{
+				Protocol: tt.protocol,
+				Endpoint: "127.0.0.1:4317",
+				Insecure: true,
+			})
+			if err != nil {
+				t.Fatalf("newOTLPExporter(protocol=%q) returned %v, want nil", tt.protocol, err)
+			}
+			if exp == nil {
+				t.Fatalf("newOTLPExporter(protocol=%q) returned a nil exporter", tt.protocol)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package opentelemetry
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/asyncfloat64"
+
+	tally "github.com/uber-go/tally"
+)
+
+// cachedCounter adapts an instrument.Int64Counter to tally.CachedCount.
+type cachedCounter struct {
+	counter instrument.Int64Counter
+	attrs   []attribute.KeyValue
+}
+
+func (c *cachedCounter) ReportCount(value int64) {
+	if c.counter == nil {
+		return
+	}
+	c.counter.Add(context.Background(), value, c.attrs...)
+}
+
+// cachedTimer adapts a Float64Histogram to tally.CachedTimer.
+type cachedTimer struct {
+	histogram instrument.Float64Histogram
+	attrs     []attribute.KeyValue
+}
+
+func (t *cachedTimer) ReportTimer(interval time.Duration) {
+	if t.histogram == nil {
+		return
+	}
+	t.histogram.Record(context.Background(), interval.Seconds(), t.attrs...)
+}
+
+// cachedHistogram adapts a Float64Histogram to tally.CachedHistogram.
+// Tally reports a histogram as per-bucket sample counts rather than raw
+// observed values, so each bucket records its samples at a single
+// representative value (see bucketMidpoint) rather than 0.
+type cachedHistogram struct {
+	histogram instrument.Float64Histogram
+	attrs     []attribute.KeyValue
+}
+
+func (h *cachedHistogram) ValueBucket(
+	bucketLowerBound, bucketUpperBound float64,
+) tally.CachedHistogramBucket {
+	return &cachedHistogramBucket{
+		histogram: h.histogram,
+		attrs:     h.attrs,
+		value:     bucketMidpoint(bucketLowerBound, bucketUpperBound),
+	}
+}
+
+func (h *cachedHistogram) DurationBucket(
+	bucketLowerBound, bucketUpperBound time.Duration,
+) tally.CachedHistogramBucket {
+	return &cachedHistogramBucket{
+		histogram: h.histogram,
+		attrs:     h.attrs,
+		value:     bucketMidpoint(bucketLowerBound.Seconds(), bucketUpperBound.Seconds()),
+	}
+}
+
+// cachedHistogramBucket records each of its ReportSamples against the
+// bucket it was created for.
+type cachedHistogramBucket struct {
+	histogram instrument.Float64Histogram
+	attrs     []attribute.KeyValue
+	value     float64
+}
+
+func (b *cachedHistogramBucket) ReportSamples(value int64) {
+	if b.histogram == nil {
+		return
+	}
+	for i := int64(0); i < value; i++ {
+		b.histogram.Record(context.Background(), b.value, b.attrs...)
+	}
+}
+
+// bucketMidpoint picks a representative value for a histogram bucket.
+// Tally's lowest/highest buckets use -Inf/+Inf bounds; in those cases
+// fall back to the finite bound so the recorded value isn't NaN/Inf.
+func bucketMidpoint(lower, upper float64) float64 {
+	switch {
+	case math.IsInf(lower, -1):
+		return upper
+	case math.IsInf(upper, 1):
+		return lower
+	default:
+		return lower + (upper-lower)/2
+	}
+}
+
+// gaugeSink adapts tally's push-based CachedGauge to an OpenTelemetry
+// ObservableGauge, which is pull-based: the most recently reported value
+// is cached and served back on the next collection callback.
+type gaugeSink struct {
+	attrs []attribute.KeyValue
+
+	mu    sync.Mutex
+	value float64
+	set   bool
+}
+
+func newGaugeSink(attrs []attribute.KeyValue) *gaugeSink {
+	return &gaugeSink{attrs: attrs}
+}
+
+func (g *gaugeSink) ReportGauge(value float64) {
+	g.mu.Lock()
+	g.value = value
+	g.set = true
+	g.mu.Unlock()
+}
+
+func (g *gaugeSink) callback(_ context.Context, obs asyncfloat64.Observer) error {
+	g.mu.Lock()
+	value, set := g.value, g.set
+	g.mu.Unlock()
+
+	if set {
+		obs.Observe(value, g.attrs...)
+	}
+	return nil
+}
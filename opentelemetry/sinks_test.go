@@ -0,0 +1,87 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// fakeFloatObserver records whether Observe was called and the last
+// value/attrs pair passed to it, so tests can assert whether
+// gaugeSink.callback reported anything at all.
+type fakeFloatObserver struct {
+	observed bool
+	value    float64
+	attrs    []attribute.KeyValue
+}
+
+func (f *fakeFloatObserver) Observe(value float64, attrs ...attribute.KeyValue) {
+	f.observed = true
+	f.value = value
+	f.attrs = attrs
+}
+
+func TestGaugeSinkCallbackBeforeFirstReport(t *testing.T) {
+	sink := newGaugeSink(nil)
+	obs := &fakeFloatObserver{}
+
+	if err := sink.callback(context.Background(), obs); err != nil {
+		t.Fatalf("callback returned %v, want nil", err)
+	}
+	if obs.observed {
+		t.Error("callback called Observe before ReportGauge was ever called; want no observation")
+	}
+}
+
+func TestGaugeSinkCallbackAfterReport(t *testing.T) {
+	attrs := []attribute.KeyValue{attribute.String("route", "/foo")}
+	sink := newGaugeSink(attrs)
+	sink.ReportGauge(42.5)
+
+	obs := &fakeFloatObserver{}
+	if err := sink.callback(context.Background(), obs); err != nil {
+		t.Fatalf("callback returned %v, want nil", err)
+	}
+	if !obs.observed {
+		t.Fatal("callback did not call Observe after ReportGauge; want the last reported value")
+	}
+	if obs.value != 42.5 {
+		t.Errorf("callback observed %v, want 42.5", obs.value)
+	}
+}
+
+func TestGaugeSinkCallbackReportsLatestValue(t *testing.T) {
+	sink := newGaugeSink(nil)
+	sink.ReportGauge(1)
+	sink.ReportGauge(2)
+	sink.ReportGauge(3)
+
+	obs := &fakeFloatObserver{}
+	if err := sink.callback(context.Background(), obs); err != nil {
+		t.Fatalf("callback returned %v, want nil", err)
+	}
+	if obs.value != 3 {
+		t.Errorf("callback observed %v, want 3 (the most recently reported value)", obs.value)
+	}
+}
@@ -21,11 +21,13 @@
 package prometheus
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 // Configuration is a configuration for a Prometheus reporter.
@@ -58,6 +60,177 @@ type Configuration struct {
 	// on the specified listen address or registering a metric with the
 	// Prometheus. By default the registerer will panic.
 	OnError string `yaml:"onError"`
+
+	// HandlerOptions configures the middleware chain that wraps the
+	// handler registered at HandlerPath.
+	HandlerOptions HandlerOptions `yaml:"handlerOptions"`
+
+	// ExtraHandlers registers additional handlers on the mux/listener
+	// that the reporter builds, e.g. "/healthz" or "/debug/pprof".
+	// It is ignored when neither ListenAddress nor DynamicListenAddress
+	// is set, since there is no dedicated mux to register them on.
+	ExtraHandlers map[string]http.Handler `yaml:"-"`
+
+	// ServerTimeouts configures the *http.Server built when
+	// ListenAddress/DynamicListenAddress is set, by both NewReporter and
+	// NewReporterAndServer; only NewReporterAndServer returns that server.
+	ServerTimeouts ServerTimeouts `yaml:"serverTimeouts"`
+
+	// NativeHistogram if specified enables Prometheus native (sparse,
+	// exponential bucket) histograms for timers/histograms registered
+	// against this reporter, instead of the classic explicit-bucket
+	// format. PerMetric allows opting specific high-cardinality metric
+	// names in (or out) by regex while leaving the rest on classic
+	// buckets.
+	NativeHistogram *NativeHistogramConfiguration `yaml:"nativeHistogram"`
+
+	// RemoteWrite if specified pushes gathered samples to a Prometheus
+	// remote-write endpoint on an interval, for deployments (serverless,
+	// short-lived jobs, behind-NAT agents) that cannot be scraped.
+	RemoteWrite *RemoteWriteConfiguration `yaml:"remoteWrite"`
+
+	// Pushgateway if specified pushes gathered samples to a Prometheus
+	// Pushgateway on an interval, as an alternative to RemoteWrite.
+	Pushgateway *PushgatewayConfiguration `yaml:"pushgateway"`
+
+	// Exemplars configures attaching trace/span exemplars to histogram
+	// observations, per the OpenMetrics exemplar spec.
+	Exemplars *ExemplarsConfiguration `yaml:"exemplars"`
+
+	// SharedMemory, if specified, switches NewReporter to
+	// NewReporterWithSharedMemory: each worker process mmaps a file
+	// under Dir and one elected aggregator merges all workers' state on
+	// every scrape, for pre-forked deployments where only one worker
+	// would otherwise be scraped.
+	SharedMemory *SharedMemoryConfiguration `yaml:"sharedMemory"`
+}
+
+// SharedMemoryConfiguration configures multi-process aggregation for
+// pre-forked worker deployments.
+type SharedMemoryConfiguration struct {
+	// Dir is the directory each worker's state file, and the
+	// aggregator's leader.lock, are created in. It must be shared
+	// (e.g. tmpfs) across all worker processes.
+	Dir string `yaml:"dir"`
+
+	// MaxFileSizeBytes bounds the size of a single worker's mmapped
+	// state file, which in turn bounds the number of distinct metric
+	// series that worker may report.
+	MaxFileSizeBytes int64 `yaml:"maxFileSizeBytes"`
+
+	// LivenessTTL is how long a worker's state file is kept after its
+	// last write before the aggregator treats it as abandoned and reaps
+	// it.
+	LivenessTTL time.Duration `yaml:"livenessTTL"`
+}
+
+// ExemplarsConfiguration configures exemplar emission on histogram
+// observations.
+type ExemplarsConfiguration struct {
+	Enabled bool `yaml:"enabled"`
+
+	// TraceIDLabel is the exemplar label name the trace id is attached
+	// under. Defaults to "trace_id".
+	TraceIDLabel string `yaml:"traceIDLabel"`
+
+	// SpanIDLabel is the exemplar label name the span id is attached
+	// under. Defaults to "span_id".
+	SpanIDLabel string `yaml:"spanIDLabel"`
+
+	// SampleRate is the fraction of observations, in [0,1], that carry
+	// an exemplar. Defaults to 1 (every observation).
+	SampleRate float64 `yaml:"sampleRate"`
+}
+
+// NativeHistogramConfiguration configures Prometheus native histograms.
+// See: https://pkg.go.dev/github.com/prometheus/client_golang/prometheus#HistogramOpts
+type NativeHistogramConfiguration struct {
+	// BucketFactor is the growth factor of one native histogram bucket
+	// to the next; NativeHistogramBucketFactor.
+	BucketFactor float64 `yaml:"bucketFactor"`
+
+	// MaxBuckets bounds the number of native histogram buckets kept
+	// before they are merged; NativeHistogramMaxBucketNumber.
+	MaxBuckets uint32 `yaml:"maxBuckets"`
+
+	// MinResetDuration is the minimum time between automatic bucket
+	// count resets; NativeHistogramMinResetDuration.
+	MinResetDuration time.Duration `yaml:"minResetDuration"`
+
+	// ZeroThreshold is the width of the zero bucket;
+	// NativeHistogramZeroThreshold.
+	ZeroThreshold float64 `yaml:"zeroThreshold"`
+
+	// PerMetric is an allowlist of metric names, matched by regex, to use
+	// native histograms for; the first matching entry wins. A metric name
+	// matching nothing stays on classic explicit-bucket histograms, so
+	// enabling NativeHistogram doesn't silently convert every histogram -
+	// an operator opts specific high-cardinality latencies in here.
+	PerMetric []NativeHistogramMetricOverride `yaml:"perMetric"`
+}
+
+// NativeHistogramMetricOverride opts a set of metric names, matched by
+// regex against the metric name, in or out of native histograms.
+type NativeHistogramMetricOverride struct {
+	// NameRegex is matched against the full metric name.
+	NameRegex string `yaml:"nameRegex"`
+
+	// Enabled overrides whether native histograms are used for metrics
+	// matching NameRegex.
+	Enabled bool `yaml:"enabled"`
+}
+
+// HandlerOptions configures middleware applied to the metrics handler
+// before it is registered on the mux.
+type HandlerOptions struct {
+	// BasicAuth if set requires HTTP basic auth credentials matching
+	// Username/Password on every scrape request.
+	BasicAuth *BasicAuthConfiguration `yaml:"basicAuth"`
+
+	// BearerToken if set requires an "Authorization: Bearer <token>"
+	// header matching this value on every scrape request.
+	BearerToken string `yaml:"bearerToken"`
+
+	// TLS configures the listener for TLS, optionally requiring client
+	// certificates signed by ClientCAFile (mTLS scraping).
+	TLS *TLSConfiguration `yaml:"tls"`
+
+	// AllowedCIDRs restricts scraping to the given client IP ranges,
+	// e.g. "10.0.0.0/8". An empty list allows all clients.
+	AllowedCIDRs []string `yaml:"allowedCIDRs"`
+
+	// EnableGzip compresses the response body when the client sends
+	// "Accept-Encoding: gzip".
+	EnableGzip bool `yaml:"enableGzip"`
+
+	// MaxRequestsInFlight bounds the number of concurrent scrapes served
+	// at once; additional requests receive a 503. Zero means unbounded.
+	MaxRequestsInFlight int `yaml:"maxRequestsInFlight"`
+}
+
+// BasicAuthConfiguration is a pair of HTTP basic auth credentials.
+type BasicAuthConfiguration struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// TLSConfiguration configures the reporter's HTTP listener for TLS and,
+// optionally, mTLS scraping. It is reused as-is by
+// RemoteWriteConfiguration.TLS to configure the push client instead,
+// where CertFile/KeyFile are presented as this process's client
+// certificate and ClientCAFile is unused.
+type TLSConfiguration struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// ServerTimeouts configures the *http.Server built by NewReporter and
+// NewReporterAndServer.
+type ServerTimeouts struct {
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
 }
 
 // HistogramObjective is a Prometheus histogram bucket.
@@ -82,6 +255,25 @@ type ConfigurationOptions struct {
 func (c Configuration) NewReporter(
 	configOpts ConfigurationOptions,
 ) (Reporter, error) {
+	reporter, _, err := c.newReporter(configOpts)
+	return reporter, err
+}
+
+// NewReporterAndServer behaves like NewReporter, but additionally returns
+// the *http.Server it built when ListenAddress/DynamicListenAddress is
+// set, so that callers can gracefully Shutdown(ctx) the scrape listener
+// instead of leaking the goroutine NewReporter starts internally. The
+// returned server is nil when the reporter only registered its handler
+// on the default mux.
+func (c Configuration) NewReporterAndServer(
+	configOpts ConfigurationOptions,
+) (Reporter, *http.Server, error) {
+	return c.newReporter(configOpts)
+}
+
+func (c Configuration) newReporter(
+	configOpts ConfigurationOptions,
+) (Reporter, *http.Server, error) {
 	if configOpts.OnError == nil {
 		switch c.OnError {
 		case "stderr":
@@ -101,6 +293,36 @@ func (c Configuration) NewReporter(
 		}
 	}
 
+	if c.SharedMemory != nil {
+		reporter, server, err := NewReporterWithSharedMemory(c, *c.SharedMemory, configOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := c.startEgress(reporter, configOpts); err != nil {
+			return nil, nil, err
+		}
+		return reporter, server, nil
+	}
+
+	opts, err := c.buildOptions(configOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reporter := NewReporter(opts)
+	reporter, err = c.wrapSinkOptions(reporter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.newReporterWithReporter(reporter, configOpts)
+}
+
+// buildOptions translates the Configuration into the Options NewReporter
+// accepts, applying TimerType and default buckets/objectives, and also
+// resolves NativeHistogram/Exemplars onto opts for wrapSinkOptions to
+// apply once the reporter exists.
+func (c Configuration) buildOptions(configOpts ConfigurationOptions) (Options, error) {
 	var opts Options
 	opts.OnRegisterError = configOpts.OnError
 
@@ -127,31 +349,143 @@ func (c Configuration) NewReporter(
 		opts.DefaultSummaryObjectives = values
 	}
 
-	reporter := NewReporter(opts)
+	if c.NativeHistogram != nil {
+		nativeOpts, err := c.NativeHistogram.toOptions()
+		if err != nil {
+			return Options{}, err
+		}
+		opts.NativeHistogram = nativeOpts
+	}
+
+	if c.Exemplars != nil {
+		opts.Exemplars = c.Exemplars.toOptions()
+	}
+
+	return opts, nil
+}
+
+// wrapSinkOptions decorates reporter with sinkReporter via
+// NewReporterWithSinkOptions when opts.NativeHistogram or opts.Exemplars is
+// set, so that those settings actually affect how timer/histogram sinks
+// are registered. It is called by both newReporter and
+// NewReporterWithSharedMemory, and is a no-op, returning reporter
+// unchanged, when neither is configured.
+func (c Configuration) wrapSinkOptions(reporter Reporter, opts Options) (Reporter, error) {
+	if opts.NativeHistogram == nil && opts.Exemplars == nil {
+		return reporter, nil
+	}
+	return NewReporterWithSinkOptions(reporter, opts)
+}
+
+// startEgress starts RemoteWrite/Pushgateway, if configured, pushing from
+// reporter. It is called both by newReporterWithReporter (the normal
+// listener/mux path) and directly by newReporter's SharedMemory branch,
+// since NewReporterWithSharedMemory's per-process worker reporter never
+// reaches newReporterWithReporter itself (the aggregator runs its own,
+// separately leader-elected listener in serveSHMAggregate) but still
+// needs its own samples pushed if RemoteWrite/Pushgateway is configured
+// alongside SharedMemory.
+func (c Configuration) startEgress(reporter Reporter, configOpts ConfigurationOptions) error {
+	if c.RemoteWrite != nil {
+		if err := startRemoteWrite(reporter, *c.RemoteWrite, configOpts.OnError); err != nil {
+			return err
+		}
+	}
+
+	if c.Pushgateway != nil {
+		if err := startPushgateway(reporter, *c.Pushgateway, configOpts.OnError); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wrapExtraHandlers registers each of c.ExtraHandlers on mux behind the
+// same HandlerOptions middleware chain (BasicAuth/BearerToken/AllowedCIDRs/
+// etc.) as the metrics handler, so that e.g. a pprof handler added via
+// ExtraHandlers doesn't bypass the auth/IP restrictions locking down the
+// rest of the listener.
+func (c Configuration) wrapExtraHandlers(mux *http.ServeMux) error {
+	for extraPath, extraHandler := range c.ExtraHandlers {
+		wrapped, err := c.HandlerOptions.wrap(extraHandler)
+		if err != nil {
+			return err
+		}
+		mux.Handle(extraPath, wrapped)
+	}
+	return nil
+}
+
+// newReporterWithReporter finishes constructing the egress paths
+// (RemoteWrite/Pushgateway), handler middleware, and optional listener for
+// an already-constructed Reporter. It is used by the normal NewReporter
+// path only; the SharedMemory path serves its merged aggregate through
+// serveSHMAggregate instead.
+func (c Configuration) newReporterWithReporter(
+	reporter Reporter,
+	configOpts ConfigurationOptions,
+) (Reporter, *http.Server, error) {
+	if err := c.startEgress(reporter, configOpts); err != nil {
+		return nil, nil, err
+	}
 
 	path := "/metrics"
 	if handlerPath := strings.TrimSpace(c.HandlerPath); handlerPath != "" {
 		path = handlerPath
 	}
 
+	handler, err := c.HandlerOptions.wrap(reporter.HTTPHandler())
+	if err != nil {
+		return nil, nil, err
+	}
+
 	addr, resolved, err := c.resolveListenAddress()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if !resolved {
-		http.Handle(path, reporter.HTTPHandler())
-	} else {
-		mux := http.NewServeMux()
-		mux.Handle(path, reporter.HTTPHandler())
-		go func() {
-			if err := http.ListenAndServe(addr, mux); err != nil {
-				configOpts.OnError(err)
-			}
-		}()
+		http.Handle(path, handler)
+		return reporter, nil, nil
 	}
 
-	return reporter, nil
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	if err := c.wrapExtraHandlers(mux); err != nil {
+		return nil, nil, err
+	}
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  c.ServerTimeouts.ReadTimeout,
+		WriteTimeout: c.ServerTimeouts.WriteTimeout,
+		IdleTimeout:  c.ServerTimeouts.IdleTimeout,
+	}
+
+	var tlsCfg *tls.Config
+	if c.HandlerOptions.TLS != nil {
+		tlsCfg, err = c.HandlerOptions.TLS.buildTLSConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		server.TLSConfig = tlsCfg
+	}
+
+	go func() {
+		var serveErr error
+		if tlsCfg != nil {
+			serveErr = server.ListenAndServeTLS(c.HandlerOptions.TLS.CertFile, c.HandlerOptions.TLS.KeyFile)
+		} else {
+			serveErr = server.ListenAndServe()
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			configOpts.OnError(serveErr)
+		}
+	}()
+
+	return reporter, server, nil
 }
 
 func (c Configuration) resolveListenAddress() (addr string, resolved bool, err error) {
@@ -171,4 +505,4 @@ func (c Configuration) resolveListenAddress() (addr string, resolved bool, err e
 	}
 
 	return addr, true, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"context"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ExemplarExtractor pulls exemplar labels (e.g. trace/span id) out of a
+// context for attachment to a histogram observation.
+type ExemplarExtractor func(ctx context.Context) promclient.Labels
+
+// ExemplarsOptions is the resolved form of ExemplarsConfiguration,
+// attached to Options.
+type ExemplarsOptions struct {
+	Extractor  ExemplarExtractor
+	SampleRate float64
+}
+
+func (c *ExemplarsConfiguration) toOptions() *ExemplarsOptions {
+	if !c.Enabled {
+		return nil
+	}
+
+	traceIDLabel := c.TraceIDLabel
+	if traceIDLabel == "" {
+		traceIDLabel = "trace_id"
+	}
+	spanIDLabel := c.SpanIDLabel
+	if spanIDLabel == "" {
+		spanIDLabel = "span_id"
+	}
+	sampleRate := c.SampleRate
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+
+	return &ExemplarsOptions{
+		Extractor:  DefaultExemplarExtractor(traceIDLabel, spanIDLabel),
+		SampleRate: sampleRate,
+	}
+}
+
+// DefaultExemplarExtractor returns an ExemplarExtractor that pulls the
+// current OpenTelemetry span context off ctx and emits its trace/span ids
+// under the given label names. It emits no labels (and therefore no
+// exemplar) when ctx carries no valid span context; whether the span is
+// sampled or recording is not checked.
+func DefaultExemplarExtractor(traceIDLabel, spanIDLabel string) ExemplarExtractor {
+	return func(ctx context.Context) promclient.Labels {
+		sc := trace.SpanContextFromContext(ctx)
+		if !sc.IsValid() {
+			return nil
+		}
+		return promclient.Labels{
+			traceIDLabel: sc.TraceID().String(),
+			spanIDLabel:  sc.SpanID().String(),
+		}
+	}
+}
+
+func labelNames(tags map[string]string) []string {
+	names := make([]string, 0, len(tags))
+	for k := range tags {
+		names = append(names, k)
+	}
+	return names
+}
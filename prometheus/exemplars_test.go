@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeExemplarObserver implements promclient.ExemplarObserver as well as
+// the plain promclient.Observer it embeds, so tests can tell which of the
+// two observeWithExemplar actually called.
+type fakeExemplarObserver struct {
+	observeCalls        int
+	observeValue        float64
+	observeWithExemplar bool
+	exemplarValue       float64
+	exemplarLabels      promclient.Labels
+}
+
+func (f *fakeExemplarObserver) Observe(v float64) {
+	f.observeCalls++
+	f.observeValue = v
+}
+
+func (f *fakeExemplarObserver) ObserveWithExemplar(v float64, exemplar promclient.Labels) {
+	f.observeWithExemplar = true
+	f.exemplarValue = v
+	f.exemplarLabels = exemplar
+}
+
+func alwaysLabels(ctx context.Context) promclient.Labels {
+	return promclient.Labels{"trace_id": "abc"}
+}
+
+func noLabels(ctx context.Context) promclient.Labels {
+	return nil
+}
+
+func TestObserveWithExemplarNotConfigured(t *testing.T) {
+	obs := &fakeExemplarObserver{}
+	observeWithExemplar(obs, ExemplarsOptions{}, context.Background(), 1)
+
+	if obs.observeWithExemplar {
+		t.Error("observeWithExemplar called ObserveWithExemplar with no Extractor configured")
+	}
+	if obs.observeCalls != 1 || obs.observeValue != 1 {
+		t.Errorf("got %d plain Observe calls with value %v, want 1 call with value 1", obs.observeCalls, obs.observeValue)
+	}
+}
+
+func TestObserveWithExemplarNotAnExemplarObserver(t *testing.T) {
+	plain := &fakeObserver{}
+	opts := ExemplarsOptions{Extractor: alwaysLabels, SampleRate: 1}
+
+	observeWithExemplar(plain, opts, context.Background(), 2)
+
+	if plain.calls != 1 || plain.value != 2 {
+		t.Errorf("got %d plain Observe calls with value %v, want 1 call with value 2 (observer doesn't support exemplars)", plain.calls, plain.value)
+	}
+}
+
+func TestObserveWithExemplarNoLabelsExtracted(t *testing.T) {
+	obs := &fakeExemplarObserver{}
+	opts := ExemplarsOptions{Extractor: noLabels, SampleRate: 1}
+
+	observeWithExemplar(obs, opts, context.Background(), 3)
+
+	if obs.observeWithExemplar {
+		t.Error("observeWithExemplar called ObserveWithExemplar when the extractor returned no labels")
+	}
+	if obs.observeCalls != 1 || obs.observeValue != 3 {
+		t.Errorf("got %d plain Observe calls with value %v, want 1 call with value 3", obs.observeCalls, obs.observeValue)
+	}
+}
+
+func TestObserveWithExemplarAttachesExemplar(t *testing.T) {
+	obs := &fakeExemplarObserver{}
+	opts := ExemplarsOptions{Extractor: alwaysLabels, SampleRate: 1}
+
+	observeWithExemplar(obs, opts, context.Background(), 4)
+
+	if !obs.observeWithExemplar {
+		t.Fatal("observeWithExemplar did not call ObserveWithExemplar when an ExemplarObserver and labels were available")
+	}
+	if obs.exemplarValue != 4 {
+		t.Errorf("ObserveWithExemplar got value %v, want 4", obs.exemplarValue)
+	}
+	if obs.exemplarLabels["trace_id"] != "abc" {
+		t.Errorf("ObserveWithExemplar got labels %v, want trace_id=abc", obs.exemplarLabels)
+	}
+	if obs.observeCalls != 0 {
+		t.Errorf("plain Observe was also called %d times, want 0 (ObserveWithExemplar should be the sole record)", obs.observeCalls)
+	}
+}
+
+func TestObserveWithExemplarZeroSampleRateNeverSamples(t *testing.T) {
+	obs := &fakeExemplarObserver{}
+	opts := ExemplarsOptions{Extractor: alwaysLabels, SampleRate: 0}
+
+	for i := 0; i < 50; i++ {
+		observeWithExemplar(obs, opts, context.Background(), 1)
+	}
+
+	if obs.observeWithExemplar {
+		t.Error("observeWithExemplar sampled at least once with SampleRate 0, want never")
+	}
+	if obs.observeCalls != 50 {
+		t.Errorf("got %d plain Observe calls, want 50 (every call falls back to plain Observe)", obs.observeCalls)
+	}
+}
+
+func TestObserveWithExemplarFullSampleRateAlwaysSamples(t *testing.T) {
+	obs := &fakeExemplarObserver{}
+	opts := ExemplarsOptions{Extractor: alwaysLabels, SampleRate: 1}
+
+	for i := 0; i < 50; i++ {
+		observeWithExemplar(obs, opts, context.Background(), 1)
+	}
+
+	if obs.observeCalls != 0 {
+		t.Errorf("got %d plain Observe calls, want 0 (SampleRate 1 should always attach an exemplar)", obs.observeCalls)
+	}
+}
+
+func TestShouldSampleExemplarBoundaries(t *testing.T) {
+	if !shouldSampleExemplar(1) {
+		t.Error("shouldSampleExemplar(1) = false, want true (rate >= 1 always samples)")
+	}
+	if !shouldSampleExemplar(2) {
+		t.Error("shouldSampleExemplar(2) = false, want true (rate > 1 always samples)")
+	}
+	for i := 0; i < 50; i++ {
+		if shouldSampleExemplar(0) {
+			t.Fatal("shouldSampleExemplar(0) = true on some call, want always false")
+		}
+	}
+}
+
+func TestExemplarsConfigurationToOptionsDisabled(t *testing.T) {
+	c := &ExemplarsConfiguration{Enabled: false}
+	if got := c.toOptions(); got != nil {
+		t.Errorf("toOptions() = %+v, want nil when Enabled is false", got)
+	}
+}
+
+func TestExemplarsConfigurationToOptionsDefaults(t *testing.T) {
+	c := &ExemplarsConfiguration{Enabled: true}
+	opts := c.toOptions()
+	if opts == nil {
+		t.Fatal("toOptions() = nil, want non-nil when Enabled is true")
+	}
+	if opts.SampleRate != 1 {
+		t.Errorf("SampleRate = %v, want 1 (default)", opts.SampleRate)
+	}
+
+	labels := opts.Extractor(context.Background())
+	if labels != nil {
+		t.Errorf("default extractor returned %v for a context with no span, want nil", labels)
+	}
+}
+
+func TestExemplarsConfigurationToOptionsCustomLabels(t *testing.T) {
+	c := &ExemplarsConfiguration{
+		Enabled:      true,
+		TraceIDLabel: "tid",
+		SpanIDLabel:  "sid",
+		SampleRate:   0.5,
+	}
+	opts := c.toOptions()
+	if opts == nil {
+		t.Fatal("toOptions() = nil, want non-nil when Enabled is true")
+	}
+	if opts.SampleRate != 0.5 {
+		t.Errorf("SampleRate = %v, want 0.5", opts.SampleRate)
+	}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1},
+		SpanID:  trace.SpanID{2},
+	})
+	labels := opts.Extractor(trace.ContextWithSpanContext(context.Background(), sc))
+	if labels["tid"] != sc.TraceID().String() || labels["sid"] != sc.SpanID().String() {
+		t.Errorf("extractor returned %v, want trace/span ids under the custom labels tid/sid", labels)
+	}
+}
+
+// fakeObserver implements only promclient.Observer, not ExemplarObserver,
+// so observeWithExemplar must fall back to Observe for it regardless of
+// configuration.
+type fakeObserver struct {
+	calls int
+	value float64
+}
+
+func (f *fakeObserver) Observe(v float64) {
+	f.calls++
+	f.value = v
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wrap builds the middleware chain described by HandlerOptions around the
+// given handler. Middleware is applied in a fixed, documented order so
+// that, e.g., an unauthenticated caller is rejected before a CIDR check
+// leaks whether their IP would otherwise have been allowed.
+func (h HandlerOptions) wrap(handler http.Handler) (http.Handler, error) {
+	wrapped := handler
+
+	if h.EnableGzip {
+		wrapped = gzipMiddleware(wrapped)
+	}
+
+	if len(h.AllowedCIDRs) > 0 {
+		nets, err := parseCIDRs(h.AllowedCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = cidrMiddleware(nets, wrapped)
+	}
+
+	if h.MaxRequestsInFlight > 0 {
+		wrapped = maxInFlightMiddleware(h.MaxRequestsInFlight, wrapped)
+	}
+
+	if h.BearerToken != "" {
+		wrapped = bearerTokenMiddleware(h.BearerToken, wrapped)
+	}
+
+	if h.BasicAuth != nil {
+		wrapped = basicAuthMiddleware(*h.BasicAuth, wrapped)
+	}
+
+	return wrapped, nil
+}
+
+func basicAuthMiddleware(auth BasicAuthConfiguration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tally"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerTokenMiddleware(token string, next http.Handler) http.Handler {
+	expected := "Bearer " + token
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func cidrMiddleware(nets []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: invalid allowed CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func maxInFlightMiddleware(max int, next http.Handler) http.Handler {
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.writer.Write(b)
+}
+
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, writer: gz}, r)
+	})
+}
+
+// buildTLSConfig translates a TLSConfiguration into a *tls.Config,
+// configuring mTLS (tls.RequireAndVerifyClientCert) when ClientCAFile is
+// set, and loading CertFile/KeyFile as a certificate to present when both
+// are set. As a listener config that certificate is redundant with the
+// CertFile/KeyFile already passed to ListenAndServeTLS; as
+// RemoteWriteConfiguration.TLS (a client config) it's how this process
+// authenticates itself to a collector that requires client certs.
+func (t *TLSConfiguration) buildTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	if t.CertFile != "" && t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: loading TLS certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	caCert, err := ioutil.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: reading client CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("prometheus: no certificates found in client CA file %q", t.ClientCAFile)
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return cfg, nil
+}
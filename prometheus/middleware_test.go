@@ -0,0 +1,207 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	auth := BasicAuthConfiguration{Username: "user", Password: "pass"}
+	handler := basicAuthMiddleware(auth, okHandler())
+
+	tests := []struct {
+		name           string
+		username       string
+		password       string
+		setCredentials bool
+		wantStatus     int
+	}{
+		{name: "correct credentials", username: "user", password: "pass", setCredentials: true, wantStatus: http.StatusOK},
+		{name: "wrong password", username: "user", password: "wrong", setCredentials: true, wantStatus: http.StatusUnauthorized},
+		{name: "wrong username", username: "other", password: "pass", setCredentials: true, wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", setCredentials: false, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.setCredentials {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestBearerTokenMiddleware(t *testing.T) {
+	handler := bearerTokenMiddleware("secret", okHandler())
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{name: "correct token", header: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "wrong token", header: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "missing header", header: "", wantStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", header: "Basic secret", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCidrMiddleware(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parseCIDRs returned %v", err)
+	}
+	handler := cidrMiddleware(nets, okHandler())
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "in range", remoteAddr: "10.1.2.3:4567", wantStatus: http.StatusOK},
+		{name: "out of range", remoteAddr: "192.168.1.1:4567", wantStatus: http.StatusForbidden},
+		{name: "no port", remoteAddr: "10.1.2.3", wantStatus: http.StatusOK},
+		{name: "unparseable address", remoteAddr: "not-an-ip", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	if _, err := parseCIDRs([]string{"not-a-cidr"}); err == nil {
+		t.Error("parseCIDRs returned nil error for an invalid CIDR, want an error")
+	}
+}
+
+func TestMaxInFlightMiddlewareRejectsOverCapacity(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := maxInFlightMiddleware(1, blocking)
+
+	// Occupy the single in-flight slot with a request that won't complete
+	// until we release it.
+	done := make(chan struct{})
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		close(done)
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while the single slot was occupied, want 503", rec.Code)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestMaxInFlightMiddlewareAllowsUnderCapacity(t *testing.T) {
+	handler := maxInFlightMiddleware(2, okHandler())
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("request %d got status %d, want 200", i, rec.Code)
+		}
+	}
+}
+
+func TestBuildTLSConfigNoFieldsSet(t *testing.T) {
+	tls := &TLSConfiguration{}
+	cfg, err := tls.buildTLSConfig()
+	if err != nil {
+		t.Fatalf("buildTLSConfig returned %v, want nil", err)
+	}
+	if len(cfg.Certificates) != 0 {
+		t.Errorf("got %d certificates, want 0 when CertFile/KeyFile are unset", len(cfg.Certificates))
+	}
+	if cfg.ClientCAs != nil {
+		t.Error("got non-nil ClientCAs when ClientCAFile is unset")
+	}
+}
+
+func TestBuildTLSConfigMissingCertFile(t *testing.T) {
+	tls := &TLSConfiguration{CertFile: "/does/not/exist.pem", KeyFile: "/does/not/exist-key.pem"}
+	if _, err := tls.buildTLSConfig(); err == nil {
+		t.Error("buildTLSConfig returned nil error for a nonexistent certificate file, want an error")
+	}
+}
+
+func TestBuildTLSConfigMissingClientCAFile(t *testing.T) {
+	tls := &TLSConfiguration{ClientCAFile: "/does/not/exist-ca.pem"}
+	if _, err := tls.buildTLSConfig(); err == nil {
+		t.Error("buildTLSConfig returned nil error for a nonexistent client CA file, want an error")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NativeHistogramOptions is the resolved, regex-compiled form of
+// NativeHistogramConfiguration, consulted by sinkReporter's histogram
+// registration when it creates a new histogram or timer sink.
+type NativeHistogramOptions struct {
+	BucketFactor     float64
+	MaxBuckets       uint32
+	MinResetDuration time.Duration
+	ZeroThreshold    float64
+
+	overrides []nativeHistogramOverride
+}
+
+type nativeHistogramOverride struct {
+	regex   *regexp.Regexp
+	enabled bool
+}
+
+func (c *NativeHistogramConfiguration) toOptions() (*NativeHistogramOptions, error) {
+	opts := &NativeHistogramOptions{
+		BucketFactor:     c.BucketFactor,
+		MaxBuckets:       c.MaxBuckets,
+		MinResetDuration: c.MinResetDuration,
+		ZeroThreshold:    c.ZeroThreshold,
+	}
+
+	for _, override := range c.PerMetric {
+		re, err := regexp.Compile(override.NameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: invalid native histogram metric regex %q: %v", override.NameRegex, err)
+		}
+		opts.overrides = append(opts.overrides, nativeHistogramOverride{
+			regex:   re,
+			enabled: override.Enabled,
+		})
+	}
+
+	return opts, nil
+}
+
+// UseNativeHistogram reports whether native histograms should be used
+// for the given metric name: PerMetric is an allowlist, consulted in
+// order, with the first matching regex winning; a name matching nothing
+// stays on classic explicit-bucket histograms. This lets an operator turn
+// on NativeHistogram and opt a single high-cardinality latency metric in
+// via PerMetric without silently converting every other histogram too.
+func (o *NativeHistogramOptions) UseNativeHistogram(name string) bool {
+	if o == nil {
+		return false
+	}
+	for _, override := range o.overrides {
+		if override.regex.MatchString(name) {
+			return override.enabled
+		}
+	}
+	return false
+}
+
+// applyTo sets the native histogram fields on a promclient.HistogramOpts
+// in place of explicit Buckets, for use by sinkReporter.registerHistogram
+// when UseNativeHistogram(name) is true.
+func (o *NativeHistogramOptions) applyTo(histOpts *promclient.HistogramOpts) {
+	if o == nil {
+		return
+	}
+	histOpts.Buckets = nil
+	histOpts.NativeHistogramBucketFactor = o.BucketFactor
+	histOpts.NativeHistogramMaxBucketNumber = o.MaxBuckets
+	histOpts.NativeHistogramMinResetDuration = o.MinResetDuration
+	histOpts.NativeHistogramZeroThreshold = o.ZeroThreshold
+}
+
+// handlerOpts are the promhttp.HandlerOpts the metrics handler is built
+// with (via promhttp.HandlerFor) when NativeHistogram or Exemplars is
+// configured, so that OpenMetrics negotiation (and therefore native
+// histogram and exemplar serialization) is actually offered on scrape. DisableCompression is set
+// so promhttp doesn't gzip the body itself: HandlerOptions.wrap applies
+// gzipMiddleware on top of this handler when EnableGzip is set, and two
+// compressors stacked would double-encode the body behind a single
+// Content-Encoding: gzip header.
+func handlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{EnableOpenMetrics: true, DisableCompression: true}
+}
@@ -0,0 +1,403 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// RemoteWriteConfiguration configures pushing gathered samples to a
+// Prometheus remote-write endpoint on an interval, for deployments that
+// cannot be scraped directly.
+type RemoteWriteConfiguration struct {
+	// URL is the remote-write endpoint, e.g.
+	// "https://collector:9090/api/v1/write".
+	URL string `yaml:"url"`
+
+	// Interval is how often samples are gathered and pushed.
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout bounds each push request.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Headers are additional headers sent with every push request.
+	Headers map[string]string `yaml:"headers"`
+
+	// BasicAuth, if set, is sent on every push request.
+	BasicAuth *BasicAuthConfiguration `yaml:"basicAuth"`
+
+	// BearerTokenFile, if set, is read on every push request and sent as
+	// an "Authorization: Bearer <token>" header.
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+
+	// TLS configures the client used to reach URL: CertFile/KeyFile are
+	// presented as a client certificate when URL requires mTLS.
+	TLS *TLSConfiguration `yaml:"tls"`
+
+	// Compression selects the request body encoding. Valid values are
+	// "snappy" (the default, per the remote-write spec) and "none".
+	Compression string `yaml:"compression"`
+
+	// ExternalLabels are attached to every series pushed.
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+
+	// QueueConfig bounds retry/backoff behavior of the push loop.
+	QueueConfig RemoteWriteQueueConfiguration `yaml:"queueConfig"`
+}
+
+// RemoteWriteQueueConfiguration bounds the remote-write push loop's
+// batching and retry behavior. There is no persistent queue or sharding
+// here (each tick gathers and sends directly), so this only covers
+// per-send batch size and the retry deadline.
+type RemoteWriteQueueConfiguration struct {
+	// MaxSamplesPerSend caps how many series one POST carries; a gather
+	// that returns more is split into multiple sequential requests.
+	// Zero (the default) sends everything gathered in a single request.
+	MaxSamplesPerSend int `yaml:"maxSamplesPerSend"`
+
+	BatchSendDeadline time.Duration `yaml:"batchSendDeadline"`
+}
+
+// PushgatewayConfiguration configures pushing gathered samples to a
+// Prometheus Pushgateway on an interval, as an alternative egress path to
+// RemoteWrite.
+type PushgatewayConfiguration struct {
+	URL string `yaml:"url"`
+
+	// Job is the Pushgateway "job" grouping key.
+	Job string `yaml:"job"`
+
+	// Grouping are additional Pushgateway grouping key/value pairs.
+	Grouping map[string]string `yaml:"grouping"`
+
+	// Interval is how often samples are pushed.
+	Interval time.Duration `yaml:"interval"`
+
+	// Replace selects push.Pusher's .Add() (merge, the default) vs
+	// .Push() (replace) semantics for the job/grouping key.
+	Replace bool `yaml:"replace"`
+}
+
+// gatherer is implemented by reporters that expose the underlying
+// Prometheus registry they register metrics against. It is consulted via
+// a type assertion since it is not part of the Reporter interface,
+// keeping remote-write/Pushgateway support opt-in and backwards
+// compatible with reporters that don't support it.
+type gatherer interface {
+	Registerer() promclient.Registerer
+}
+
+func startRemoteWrite(reporter Reporter, cfg RemoteWriteConfiguration, onError func(error)) error {
+	g, ok := reporter.(gatherer)
+	if !ok {
+		return fmt.Errorf("prometheus: remote write requires a reporter that exposes its registry")
+	}
+	registry, ok := g.Registerer().(promclient.Gatherer)
+	if !ok {
+		return fmt.Errorf("prometheus: remote write requires a registerer that is also a Gatherer")
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	client := &http.Client{Timeout: timeout}
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.buildTLSConfig()
+		if err != nil {
+			return fmt.Errorf("prometheus: remote write TLS config: %v", err)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsCfg}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := pushRemoteWrite(client, registry, cfg); err != nil {
+				onError(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func pushRemoteWrite(client *http.Client, gatherer promclient.Gatherer, cfg RemoteWriteConfiguration) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("prometheus: remote write gather: %v", err)
+	}
+
+	series := metricFamiliesToTimeseries(families, cfg.ExternalLabels)
+	for _, batch := range batchTimeseries(series, cfg.QueueConfig.MaxSamplesPerSend) {
+		if err := sendTimeseries(client, cfg, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchTimeseries splits series into chunks of at most maxPerSend so a
+// large gather doesn't balloon into one oversized POST; maxPerSend<=0
+// (the default) sends everything in a single batch.
+func batchTimeseries(series []prompb.TimeSeries, maxPerSend int) [][]prompb.TimeSeries {
+	if maxPerSend <= 0 || len(series) <= maxPerSend {
+		return [][]prompb.TimeSeries{series}
+	}
+
+	batches := make([][]prompb.TimeSeries, 0, (len(series)+maxPerSend-1)/maxPerSend)
+	for start := 0; start < len(series); start += maxPerSend {
+		end := start + maxPerSend
+		if end > len(series) {
+			end = len(series)
+		}
+		batches = append(batches, series[start:end])
+	}
+	return batches
+}
+
+func sendTimeseries(client *http.Client, cfg RemoteWriteConfiguration, series []prompb.TimeSeries) error {
+	writeReq := &prompb.WriteRequest{Timeseries: series}
+
+	data, err := writeReq.Marshal()
+	if err != nil {
+		return fmt.Errorf("prometheus: remote write marshal: %v", err)
+	}
+
+	body := data
+	if cfg.Compression != "none" {
+		body = snappy.Encode(nil, data)
+	}
+
+	return sendRemoteWriteWithRetry(client, cfg, body)
+}
+
+func sendRemoteWriteWithRetry(client *http.Client, cfg RemoteWriteConfiguration, body []byte) error {
+	deadline := cfg.QueueConfig.BatchSendDeadline
+	if deadline <= 0 {
+		deadline = 30 * time.Second
+	}
+	start := time.Now()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if cfg.Compression != "none" {
+			req.Header.Set("Content-Encoding", "snappy")
+		}
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		for k, v := range cfg.Headers {
+			req.Header.Set(k, v)
+		}
+		if cfg.BasicAuth != nil {
+			req.SetBasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password)
+		}
+		if cfg.BearerTokenFile != "" {
+			token, err := ioutil.ReadFile(cfg.BearerTokenFile)
+			if err != nil {
+				return fmt.Errorf("prometheus: reading bearer token file: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			if !isRetryableStatus(resp.StatusCode) {
+				return fmt.Errorf("prometheus: remote write returned %d", resp.StatusCode)
+			}
+		}
+
+		if time.Since(start) >= deadline {
+			// Drop the batch; the error is returned once for the whole
+			// push, so the caller surfaces it via OnError on a per-push
+			// basis, not per-retry.
+			return fmt.Errorf("prometheus: remote write dropped batch after retrying for %v", deadline)
+		}
+
+		backoff := time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+		jitter := time.Duration(rand.Int63n(int64(backoff) + 1))
+		time.Sleep(backoff + jitter)
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code/100 == 5
+}
+
+func metricFamiliesToTimeseries(
+	families []*dto.MetricFamily, externalLabels map[string]string,
+) []prompb.TimeSeries {
+	var series []prompb.TimeSeries
+	ts := time.Now().UnixMilli()
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			var extra []prompb.Label
+			for _, lp := range m.Label {
+				extra = append(extra, prompb.Label{Name: lp.GetName(), Value: lp.GetValue()})
+			}
+			for k, v := range externalLabels {
+				extra = append(extra, prompb.Label{Name: k, Value: v})
+			}
+
+			switch {
+			case m.Counter != nil:
+				series = append(series, sampleSeries(name, extra, m.Counter.GetValue(), ts))
+			case m.Gauge != nil:
+				series = append(series, sampleSeries(name, extra, m.Gauge.GetValue(), ts))
+			case m.Histogram != nil:
+				series = append(series, histogramSeries(name, extra, m.Histogram, ts)...)
+			case m.Summary != nil:
+				series = append(series, summarySeries(name, extra, m.Summary, ts)...)
+			}
+		}
+	}
+
+	return series
+}
+
+// sampleSeries builds the single timeseries a Counter/Gauge sample
+// expands to: name{extra...} value.
+func sampleSeries(name string, extra []prompb.Label, value float64, ts int64) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  append([]prompb.Label{{Name: "__name__", Value: name}}, extra...),
+		Samples: []prompb.Sample{{Value: value, Timestamp: ts}},
+	}
+}
+
+// labeledSeries builds the timeseries a histogram bucket or summary
+// quantile expands to: name{extra..., labelName=labelValue} value.
+func labeledSeries(name string, extra []prompb.Label, labelName, labelValue string, value float64, ts int64) prompb.TimeSeries {
+	labels := append([]prompb.Label{{Name: "__name__", Value: name}}, extra...)
+	labels = append(labels, prompb.Label{Name: labelName, Value: labelValue})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: value, Timestamp: ts}},
+	}
+}
+
+// histogramSeries expands a Histogram metric into the classic
+// remote-write exposition: a "<name>_bucket" series per cumulative
+// bucket (including the implicit +Inf bucket the dto.Histogram omits), a
+// "<name>_sum", and a "<name>_count" — the same series a scrape of the
+// classic text exposition format would produce.
+func histogramSeries(name string, extra []prompb.Label, h *dto.Histogram, ts int64) []prompb.TimeSeries {
+	bucketName := name + "_bucket"
+	buckets := h.GetBucket()
+	out := make([]prompb.TimeSeries, 0, len(buckets)+3)
+	for _, b := range buckets {
+		out = append(out, labeledSeries(bucketName, extra, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()), ts))
+	}
+	if n := len(buckets); n == 0 || !math.IsInf(buckets[n-1].GetUpperBound(), 1) {
+		out = append(out, labeledSeries(bucketName, extra, "le", "+Inf", float64(h.GetSampleCount()), ts))
+	}
+	out = append(out, sampleSeries(name+"_sum", extra, h.GetSampleSum(), ts))
+	out = append(out, sampleSeries(name+"_count", extra, float64(h.GetSampleCount()), ts))
+	return out
+}
+
+// summarySeries expands a Summary metric into a "<name>" series per
+// quantile (labeled "quantile", as the classic exposition format does,
+// rather than "_bucket"-suffixed like a histogram), a "<name>_sum", and a
+// "<name>_count".
+func summarySeries(name string, extra []prompb.Label, s *dto.Summary, ts int64) []prompb.TimeSeries {
+	out := make([]prompb.TimeSeries, 0, len(s.GetQuantile())+2)
+	for _, q := range s.GetQuantile() {
+		out = append(out, labeledSeries(name, extra, "quantile", formatFloat(q.GetQuantile()), q.GetValue(), ts))
+	}
+	out = append(out, sampleSeries(name+"_sum", extra, s.GetSampleSum(), ts))
+	out = append(out, sampleSeries(name+"_count", extra, float64(s.GetSampleCount()), ts))
+	return out
+}
+
+// formatFloat renders a bucket upper bound or quantile the way the
+// classic Prometheus exposition format does, so values like +Inf and
+// 0.99 round-trip the same as a direct scrape would.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func startPushgateway(reporter Reporter, cfg PushgatewayConfiguration, onError func(error)) error {
+	g, ok := reporter.(gatherer)
+	if !ok {
+		return fmt.Errorf("prometheus: pushgateway requires a reporter that exposes its registry")
+	}
+	registry, ok := g.Registerer().(*promclient.Registry)
+	if !ok {
+		return fmt.Errorf("prometheus: pushgateway requires a *prometheus.Registry registerer")
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	pusher := push.New(cfg.URL, cfg.Job).Gatherer(registry)
+	for k, v := range cfg.Grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			var err error
+			if cfg.Replace {
+				err = pusher.Push()
+			} else {
+				err = pusher.Add()
+			}
+			if err != nil {
+				onError(fmt.Errorf("prometheus: pushgateway push: %v", err))
+			}
+		}
+	}()
+
+	return nil
+}
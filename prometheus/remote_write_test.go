@@ -0,0 +1,221 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusNotImplemented, true},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryableStatus(tt.code); got != tt.want {
+			t.Errorf("isRetryableStatus(%d) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestBatchTimeseries(t *testing.T) {
+	series := make([]prompb.TimeSeries, 5)
+
+	if got := batchTimeseries(series, 0); len(got) != 1 || len(got[0]) != 5 {
+		t.Fatalf("batchTimeseries(5 series, 0) = %d batches, want 1 batch of 5 (unbatched default)", len(got))
+	}
+	if got := batchTimeseries(series, 10); len(got) != 1 || len(got[0]) != 5 {
+		t.Fatalf("batchTimeseries(5 series, 10) = %d batches, want 1 batch of 5 (fits in one send)", len(got))
+	}
+
+	got := batchTimeseries(series, 2)
+	wantSizes := []int{2, 2, 1}
+	if len(got) != len(wantSizes) {
+		t.Fatalf("batchTimeseries(5 series, 2) = %d batches, want %d", len(got), len(wantSizes))
+	}
+	for i, want := range wantSizes {
+		if len(got[i]) != want {
+			t.Errorf("batch %d has %d series, want %d", i, len(got[i]), want)
+		}
+	}
+}
+
+func TestSendRemoteWriteWithRetrySucceedsAfterTransientFailures(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	cfg := RemoteWriteConfiguration{
+		URL:         srv.URL,
+		QueueConfig: RemoteWriteQueueConfiguration{BatchSendDeadline: time.Second},
+	}
+
+	if err := sendRemoteWriteWithRetry(srv.Client(), cfg, []byte("body")); err != nil {
+		t.Fatalf("sendRemoteWriteWithRetry returned %v, want nil after eventual success", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("server saw %d attempts, want 3 (2 retryable failures + 1 success)", got)
+	}
+}
+
+func TestSendRemoteWriteWithRetryGivesUpOnNonRetryableStatus(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	cfg := RemoteWriteConfiguration{
+		URL:         srv.URL,
+		QueueConfig: RemoteWriteQueueConfiguration{BatchSendDeadline: time.Second},
+	}
+
+	if err := sendRemoteWriteWithRetry(srv.Client(), cfg, []byte("body")); err == nil {
+		t.Fatal("sendRemoteWriteWithRetry returned nil error, want an error for a non-retryable 400")
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("server saw %d attempts, want 1 (no retry on a non-retryable status)", got)
+	}
+}
+
+func TestSendRemoteWriteWithRetryDropsBatchAfterDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cfg := RemoteWriteConfiguration{
+		URL:         srv.URL,
+		QueueConfig: RemoteWriteQueueConfiguration{BatchSendDeadline: 50 * time.Millisecond},
+	}
+
+	if err := sendRemoteWriteWithRetry(srv.Client(), cfg, []byte("body")); err == nil {
+		t.Fatal("sendRemoteWriteWithRetry returned nil, want an error reporting the batch dropped past its deadline")
+	}
+}
+
+func TestMetricFamiliesToTimeseriesHistogram(t *testing.T) {
+	family := &dto.MetricFamily{
+		Name: proto.String("latency"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{
+			Histogram: &dto.Histogram{
+				SampleSum:   proto.Float64(12.5),
+				SampleCount: proto.Uint64(4),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+					{UpperBound: proto.Float64(5), CumulativeCount: proto.Uint64(3)},
+				},
+			},
+		}},
+	}
+
+	series := metricFamiliesToTimeseries([]*dto.MetricFamily{family}, nil)
+
+	wantSeries := map[string]bool{
+		"latency_bucket": false, // expect 3: le=1, le=5, le=+Inf
+		"latency_sum":    false,
+		"latency_count":  false,
+	}
+	var bucketCount int
+	for _, s := range series {
+		name := seriesName(s)
+		if name == "latency_bucket" {
+			bucketCount++
+		}
+		if _, ok := wantSeries[name]; ok {
+			wantSeries[name] = true
+		}
+	}
+	for name, seen := range wantSeries {
+		if !seen {
+			t.Errorf("metricFamiliesToTimeseries did not emit a %q series", name)
+		}
+	}
+	if bucketCount != 3 {
+		t.Errorf("got %d latency_bucket series, want 3 (2 explicit buckets + implicit +Inf)", bucketCount)
+	}
+}
+
+func TestMetricFamiliesToTimeseriesSummary(t *testing.T) {
+	family := &dto.MetricFamily{
+		Name: proto.String("latency"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{{
+			Summary: &dto.Summary{
+				SampleSum:   proto.Float64(12.5),
+				SampleCount: proto.Uint64(4),
+				Quantile: []*dto.Quantile{
+					{Quantile: proto.Float64(0.5), Value: proto.Float64(2)},
+					{Quantile: proto.Float64(0.99), Value: proto.Float64(9)},
+				},
+			},
+		}},
+	}
+
+	series := metricFamiliesToTimeseries([]*dto.MetricFamily{family}, nil)
+	if len(series) != 4 {
+		t.Fatalf("got %d series, want 4 (2 quantiles + _sum + _count)", len(series))
+	}
+
+	var quantileCount int
+	for _, s := range series {
+		if seriesName(s) == "latency" {
+			quantileCount++
+		}
+	}
+	if quantileCount != 2 {
+		t.Errorf("got %d quantile-labeled \"latency\" series, want 2", quantileCount)
+	}
+}
+
+func seriesName(s prompb.TimeSeries) string {
+	for _, l := range s.Labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+	return ""
+}
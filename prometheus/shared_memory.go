@@ -0,0 +1,785 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/golang/protobuf/proto"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// shmDefaultMaxFileSizeBytes is used when SharedMemoryConfiguration
+	// doesn't set MaxFileSizeBytes.
+	shmDefaultMaxFileSizeBytes = 4 << 20 // 4MiB
+
+	// shmDefaultLivenessTTL is used when SharedMemoryConfiguration
+	// doesn't set LivenessTTL.
+	shmDefaultLivenessTTL = 30 * time.Second
+
+	// shmWriteInterval is how often a worker snapshots its registry into
+	// its shared memory file.
+	shmWriteInterval = time.Second
+
+	// shmLeaderRetryInterval is how often a reporter that isn't the
+	// elected aggregator retries acquiring Dir/leader.lock.
+	shmLeaderRetryInterval = 5 * time.Second
+
+	// shmMaxNameLen and shmMaxLabelsLen bound the metric name and
+	// formatted label string a record can carry; longer ones are
+	// truncated.
+	shmMaxNameLen   = 64
+	shmMaxLabelsLen = 96
+
+	// shmMaxBuckets bounds the number of histogram buckets a record can
+	// carry; series with more buckets have the rest truncated.
+	shmMaxBuckets = 8
+
+	// shmRecordSize is the fixed size, in bytes, of a single worker
+	// state record. A worker's file holds MaxFileSizeBytes/shmRecordSize
+	// slots, each addressed by a hash of the series' name+labels, with
+	// linear probing on collision.
+	shmRecordSize = 384
+
+	shmKindCounter byte = iota + 1
+	shmKindGauge
+	shmKindHistogram
+)
+
+// shmSeqSize is a trailing sequence-number footer on every record, used as
+// a seqlock: the writer bumps it to odd before updating a record and back
+// to even once done, so the aggregator - mmapping the same file from a
+// different process, with no mutex shared between them - can detect it
+// read a record mid-write and retry instead of parsing torn fields.
+// shmDataSize is the remainder of the record available to packRecord/
+// unpackRecord.
+const (
+	shmSeqSize  = 8
+	shmDataSize = shmRecordSize - shmSeqSize
+
+	// shmMaxSeqReadAttempts bounds how many times a reader retries a
+	// record whose seqlock it caught mid-write, so a wedged writer can't
+	// hang a scrape forever; the record is skipped for this scrape if it
+	// isn't resolved within that many attempts.
+	shmMaxSeqReadAttempts = 100
+)
+
+// shmSample is the in-memory form of one worker-reported series, keyed by
+// hash for slot addressing and merged across workers by the aggregator.
+type shmSample struct {
+	hash      uint64
+	name      string
+	labels    string
+	kind      byte
+	value     float64 // counter/gauge value, or histogram sample sum
+	count     uint64  // histogram sample count
+	nBuckets  int
+	buckets   [shmMaxBuckets]shmBucket
+	timestamp int64
+}
+
+type shmBucket struct {
+	upperBound float64
+	cumulative uint64
+}
+
+// NewReporterWithSharedMemory constructs a reporter exactly as NewReporter
+// would, but additionally mirrors its registry into a fixed-slot mmap file
+// under shm.Dir on every tick and participates in a leader election for
+// the process that serves merged output across all live worker files. It
+// is dispatched to automatically by NewReporter/NewReporterAndServer when
+// Configuration.SharedMemory is set; see SharedMemoryConfiguration.
+//
+// The returned *http.Server is non-nil only when this call wins the
+// leader election immediately (the common case: the first worker up, or
+// the previous leader's lock having already been released), so that
+// NewReporterAndServer's caller can Shutdown(ctx) it like any other
+// listener. If another process already holds the lock, leadership (and
+// its listener) is instead acquired later by a retry loop in the
+// background, which has no caller left to hand a *http.Server to.
+func NewReporterWithSharedMemory(
+	c Configuration,
+	shm SharedMemoryConfiguration,
+	configOpts ConfigurationOptions,
+) (Reporter, *http.Server, error) {
+	dir := strings.TrimSpace(shm.Dir)
+	if dir == "" {
+		return nil, nil, fmt.Errorf("prometheus: sharedMemory.dir is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("prometheus: creating sharedMemory dir: %v", err)
+	}
+
+	maxSize := shm.MaxFileSizeBytes
+	if maxSize <= 0 {
+		maxSize = shmDefaultMaxFileSizeBytes
+	}
+	ttl := shm.LivenessTTL
+	if ttl <= 0 {
+		ttl = shmDefaultLivenessTTL
+	}
+
+	opts, err := c.buildOptions(configOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	reporter := NewReporter(opts)
+	reporter, err = c.wrapSinkOptions(reporter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g, ok := reporter.(gatherer)
+	if !ok {
+		return nil, nil, fmt.Errorf("prometheus: sharedMemory requires a reporter that exposes its registry")
+	}
+	promGatherer, ok := g.Registerer().(promclient.Gatherer)
+	if !ok {
+		return nil, nil, fmt.Errorf("prometheus: sharedMemory requires a registerer that is also a Gatherer")
+	}
+
+	workerPath := filepath.Join(dir, fmt.Sprintf("worker-%d.shm", os.Getpid()))
+	worker, err := newSHMWorker(workerPath, maxSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("prometheus: opening sharedMemory worker file: %v", err)
+	}
+
+	go runSHMWorker(worker, promGatherer, configOpts.OnError)
+
+	server, err := acquireSHMLeaderOrRetryInBackground(c, dir, ttl, configOpts.OnError)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return reporter, server, nil
+}
+
+// shmWorker mmaps one worker's fixed-slot state file and writes its
+// registry's gathered samples into it on every tick.
+type shmWorker struct {
+	mu    sync.Mutex
+	file  *os.File
+	data  []byte
+	slots int
+}
+
+func newSHMWorker(path string, size int64) (*shmWorker, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	slots := int(size) / shmRecordSize
+	if slots <= 0 {
+		f.Close()
+		return nil, fmt.Errorf("prometheus: sharedMemory maxFileSizeBytes %d is too small to hold a single record", size)
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &shmWorker{file: f, data: data, slots: slots}, nil
+}
+
+// write upserts each sample into its hash-addressed slot, linear-probing
+// past slots already holding a different series, then refreshes the file's
+// mtime so the aggregator's LivenessTTL check sees this worker as alive.
+// A sample whose hash collides with every slot it probes (the file has
+// reached its configured cardinality) is dropped and reported via
+// onError rather than silently discarded.
+func (w *shmWorker) write(samples []shmSample, onError func(error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, s := range samples {
+		start := int(s.hash % uint64(w.slots))
+		stored := false
+		for i := 0; i < w.slots; i++ {
+			idx := (start + i) % w.slots
+			off := idx * shmRecordSize
+			rec := w.data[off : off+shmRecordSize]
+			existing := binary.LittleEndian.Uint64(rec[0:8])
+			if existing == 0 || existing == s.hash {
+				writeSHMRecord(rec, s)
+				stored = true
+				break
+			}
+		}
+		if !stored {
+			onError(fmt.Errorf(
+				"prometheus: sharedMemory dropped %s{%s}: worker file is full (%d slots); increase maxFileSizeBytes",
+				s.name, s.labels, w.slots))
+		}
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(w.file.Name(), now, now)
+}
+
+func runSHMWorker(worker *shmWorker, g promclient.Gatherer, onError func(error)) {
+	ticker := time.NewTicker(shmWriteInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		families, err := g.Gather()
+		if err != nil {
+			onError(fmt.Errorf("prometheus: sharedMemory gather: %v", err))
+			continue
+		}
+		worker.write(familiesToSHMSamples(families, onError), onError)
+	}
+}
+
+func familiesToSHMSamples(families []*dto.MetricFamily, onError func(error)) []shmSample {
+	now := time.Now().UnixNano()
+
+	var out []shmSample
+	for _, family := range families {
+		kind, ok := shmKindFromType(family.GetType())
+		if !ok {
+			// Summaries and untyped metrics have no well-defined way to
+			// merge across workers; they're left out of the worker file
+			// and so do not appear in the aggregator's merged output.
+			continue
+		}
+
+		for _, m := range family.Metric {
+			s := shmSample{
+				name:      truncateSHM(family.GetName(), shmMaxNameLen),
+				labels:    truncateSHM(formatSHMLabels(m.Label), shmMaxLabelsLen),
+				kind:      kind,
+				timestamp: now,
+			}
+
+			switch kind {
+			case shmKindCounter:
+				s.value = m.GetCounter().GetValue()
+			case shmKindGauge:
+				s.value = m.GetGauge().GetValue()
+			case shmKindHistogram:
+				h := m.GetHistogram()
+				s.value = h.GetSampleSum()
+				s.count = h.GetSampleCount()
+				buckets := h.GetBucket()
+				for i, b := range buckets {
+					if i >= shmMaxBuckets {
+						onError(fmt.Errorf(
+							"prometheus: sharedMemory truncated %s{%s} to %d of %d buckets; increase shmMaxBuckets",
+							s.name, s.labels, shmMaxBuckets, len(buckets)))
+						break
+					}
+					s.buckets[i] = shmBucket{upperBound: b.GetUpperBound(), cumulative: b.GetCumulativeCount()}
+					s.nBuckets = i + 1
+				}
+			}
+
+			s.hash = shmHash(s.name, s.labels)
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func shmKindFromType(t dto.MetricType) (byte, bool) {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return shmKindCounter, true
+	case dto.MetricType_GAUGE:
+		return shmKindGauge, true
+	case dto.MetricType_HISTOGRAM:
+		return shmKindHistogram, true
+	default:
+		return 0, false
+	}
+}
+
+func shmMetricType(kind byte) dto.MetricType {
+	switch kind {
+	case shmKindCounter:
+		return dto.MetricType_COUNTER
+	case shmKindHistogram:
+		return dto.MetricType_HISTOGRAM
+	default:
+		return dto.MetricType_GAUGE
+	}
+}
+
+func shmHash(name, labels string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(labels))
+	return h.Sum64()
+}
+
+func formatSHMLabels(pairs []*dto.LabelPair) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	sorted := make([]*dto.LabelPair, len(pairs))
+	copy(sorted, pairs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	parts := make([]string, len(sorted))
+	for i, p := range sorted {
+		parts[i] = p.GetName() + "=" + p.GetValue()
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseSHMLabels is the inverse of formatSHMLabels. Label values containing
+// "," or "=" are not round-tripped; the record format trades that off for a
+// fixed, allocation-free on-disk layout.
+func parseSHMLabels(labels string) []*dto.LabelPair {
+	if labels == "" {
+		return nil
+	}
+	parts := strings.Split(labels, ",")
+	out := make([]*dto.LabelPair, 0, len(parts))
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		out = append(out, &dto.LabelPair{Name: proto.String(kv[0]), Value: proto.String(kv[1])})
+	}
+	return out
+}
+
+func truncateSHM(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+// writeSHMRecord packs s into rec's data portion under the seqlock footer
+// in rec's final shmSeqSize bytes: bump the sequence to odd, write the
+// fields, then bump it back to even, so a concurrent reader either sees
+// the fully-old or fully-new record, never a torn mix of both.
+func writeSHMRecord(rec []byte, s shmSample) {
+	seq := loadSHMSeq(rec)
+	storeSHMSeq(rec, seq+1)
+	packRecord(rec[:shmDataSize], s)
+	storeSHMSeq(rec, seq+2)
+}
+
+// readSHMRecord is the reader side of the writeSHMRecord seqlock: it
+// retries while the sequence number is odd (a write is in progress) or
+// changes between the read of the data and the read of the sequence
+// (a write happened during the read), up to shmMaxSeqReadAttempts. ok is
+// false for a record that's genuinely empty (hash 0, never written) or
+// that didn't settle within the attempt budget.
+func readSHMRecord(rec []byte) (s shmSample, ok bool) {
+	data := rec[:shmDataSize]
+	for attempt := 0; attempt < shmMaxSeqReadAttempts; attempt++ {
+		seqBefore := loadSHMSeq(rec)
+		if seqBefore%2 != 0 {
+			continue
+		}
+		if binary.LittleEndian.Uint64(data[0:8]) == 0 {
+			return shmSample{}, false
+		}
+
+		candidate := unpackRecord(data)
+		if loadSHMSeq(rec) == seqBefore {
+			return candidate, true
+		}
+	}
+	return shmSample{}, false
+}
+
+func loadSHMSeq(rec []byte) uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&rec[shmDataSize])))
+}
+
+func storeSHMSeq(rec []byte, seq uint64) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&rec[shmDataSize])), seq)
+}
+
+func packRecord(dst []byte, s shmSample) {
+	for i := range dst {
+		dst[i] = 0
+	}
+
+	binary.LittleEndian.PutUint64(dst[0:8], s.hash)
+	dst[8] = s.kind
+	binary.LittleEndian.PutUint64(dst[9:17], uint64(s.timestamp))
+
+	binary.LittleEndian.PutUint16(dst[17:19], uint16(len(s.name)))
+	copy(dst[19:19+shmMaxNameLen], s.name)
+
+	labelsOff := 19 + shmMaxNameLen
+	binary.LittleEndian.PutUint16(dst[labelsOff:labelsOff+2], uint16(len(s.labels)))
+	copy(dst[labelsOff+2:labelsOff+2+shmMaxLabelsLen], s.labels)
+
+	valOff := labelsOff + 2 + shmMaxLabelsLen
+	binary.LittleEndian.PutUint64(dst[valOff:valOff+8], math.Float64bits(s.value))
+	binary.LittleEndian.PutUint64(dst[valOff+8:valOff+16], s.count)
+	binary.LittleEndian.PutUint16(dst[valOff+16:valOff+18], uint16(s.nBuckets))
+
+	bucketsOff := valOff + 18
+	for i := 0; i < s.nBuckets && i < shmMaxBuckets; i++ {
+		off := bucketsOff + i*16
+		binary.LittleEndian.PutUint64(dst[off:off+8], math.Float64bits(s.buckets[i].upperBound))
+		binary.LittleEndian.PutUint64(dst[off+8:off+16], s.buckets[i].cumulative)
+	}
+}
+
+func unpackRecord(src []byte) shmSample {
+	var s shmSample
+	s.hash = binary.LittleEndian.Uint64(src[0:8])
+	s.kind = src[8]
+	s.timestamp = int64(binary.LittleEndian.Uint64(src[9:17]))
+
+	nameLen := int(binary.LittleEndian.Uint16(src[17:19]))
+	s.name = string(src[19 : 19+nameLen])
+
+	labelsOff := 19 + shmMaxNameLen
+	labelsLen := int(binary.LittleEndian.Uint16(src[labelsOff : labelsOff+2]))
+	s.labels = string(src[labelsOff+2 : labelsOff+2+labelsLen])
+
+	valOff := labelsOff + 2 + shmMaxLabelsLen
+	s.value = math.Float64frombits(binary.LittleEndian.Uint64(src[valOff : valOff+8]))
+	s.count = binary.LittleEndian.Uint64(src[valOff+8 : valOff+16])
+	s.nBuckets = int(binary.LittleEndian.Uint16(src[valOff+16 : valOff+18]))
+
+	bucketsOff := valOff + 18
+	for i := 0; i < s.nBuckets && i < shmMaxBuckets; i++ {
+		off := bucketsOff + i*16
+		s.buckets[i] = shmBucket{
+			upperBound: math.Float64frombits(binary.LittleEndian.Uint64(src[off : off+8])),
+			cumulative: binary.LittleEndian.Uint64(src[off+8 : off+16]),
+		}
+	}
+	return s
+}
+
+// shmAggregate scans dir for live worker files, reaping ones whose mtime
+// is older than ttl (their holder is presumed dead with no one to reap its
+// own state), and merges the rest into one sample per hash: counters sum,
+// gauges keep the latest timestamp's value, and histogram sums/counts/
+// bucket counts sum.
+func shmAggregate(dir string, ttl time.Duration) (map[uint64]*shmSample, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	merged := make(map[uint64]*shmSample)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "worker-") || !strings.HasSuffix(e.Name(), ".shm") {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Before(cutoff) {
+			_ = os.Remove(path)
+			continue
+		}
+
+		samples, err := readSHMFile(path, info.Size())
+		if err != nil {
+			continue
+		}
+		for _, s := range samples {
+			mergeSHMSample(merged, s)
+		}
+	}
+
+	return merged, nil
+}
+
+func readSHMFile(path string, size int64) ([]shmSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Munmap(data)
+
+	slots := int(size) / shmRecordSize
+	out := make([]shmSample, 0, slots)
+	for i := 0; i < slots; i++ {
+		off := i * shmRecordSize
+		rec := data[off : off+shmRecordSize]
+		if s, ok := readSHMRecord(rec); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func mergeSHMSample(merged map[uint64]*shmSample, s shmSample) {
+	existing, ok := merged[s.hash]
+	if !ok {
+		cp := s
+		merged[s.hash] = &cp
+		return
+	}
+
+	switch s.kind {
+	case shmKindCounter:
+		existing.value += s.value
+	case shmKindGauge:
+		if s.timestamp > existing.timestamp {
+			existing.value = s.value
+			existing.timestamp = s.timestamp
+		}
+	case shmKindHistogram:
+		existing.value += s.value
+		existing.count += s.count
+		for i := 0; i < existing.nBuckets && i < s.nBuckets; i++ {
+			existing.buckets[i].cumulative += s.buckets[i].cumulative
+		}
+	}
+}
+
+func buildSHMMetricFamilies(merged map[uint64]*shmSample) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily)
+	for _, s := range merged {
+		mf, ok := byName[s.name]
+		if !ok {
+			mf = &dto.MetricFamily{Name: proto.String(s.name), Type: shmMetricType(s.kind).Enum()}
+			byName[s.name] = mf
+		}
+
+		metric := &dto.Metric{Label: parseSHMLabels(s.labels)}
+		switch s.kind {
+		case shmKindCounter:
+			metric.Counter = &dto.Counter{Value: proto.Float64(s.value)}
+		case shmKindGauge:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+		case shmKindHistogram:
+			buckets := make([]*dto.Bucket, 0, s.nBuckets)
+			for _, b := range s.buckets[:s.nBuckets] {
+				buckets = append(buckets, &dto.Bucket{
+					UpperBound:      proto.Float64(b.upperBound),
+					CumulativeCount: proto.Uint64(b.cumulative),
+				})
+			}
+			metric.Histogram = &dto.Histogram{
+				SampleSum:   proto.Float64(s.value),
+				SampleCount: proto.Uint64(s.count),
+				Bucket:      buckets,
+			}
+		}
+		mf.Metric = append(mf.Metric, metric)
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		out = append(out, mf)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out
+}
+
+func shmHandler(dir string, ttl time.Duration, onError func(error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merged, err := shmAggregate(dir, ttl)
+		if err != nil {
+			onError(fmt.Errorf("prometheus: sharedMemory aggregate: %v", err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		format := expfmt.NewFormat(expfmt.TypeTextPlain)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range buildSHMMetricFamilies(merged) {
+			if err := enc.Encode(mf); err != nil {
+				onError(fmt.Errorf("prometheus: sharedMemory encode: %v", err))
+				return
+			}
+		}
+	})
+}
+
+// shmHeldLeaderLocks pins the *os.File of every leader.lock this process
+// has acquired so os.File's close-on-finalize doesn't release the flock
+// out from under a goroutine that's meant to hold it for the process's
+// lifetime.
+var (
+	shmHeldLeaderLocksMu sync.Mutex
+	shmHeldLeaderLocks   []*os.File
+)
+
+func tryAcquireSHMLeader(dir string) (bool, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "leader.lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+
+	shmHeldLeaderLocksMu.Lock()
+	shmHeldLeaderLocks = append(shmHeldLeaderLocks, f)
+	shmHeldLeaderLocksMu.Unlock()
+	return true, nil
+}
+
+// acquireSHMLeaderOrRetryInBackground makes one synchronous attempt at
+// dir/leader.lock so the common case - no contention, or the previous
+// leader's lock already released - can hand its caller a real
+// *http.Server. If another process currently holds the lock, it falls
+// back to runSHMLeaderElection in the background, the same as before;
+// that retry loop has no caller left to return a server to, so it serves
+// forever with no way for this process to Shutdown(ctx) it.
+func acquireSHMLeaderOrRetryInBackground(
+	c Configuration, dir string, ttl time.Duration, onError func(error),
+) (*http.Server, error) {
+	acquired, err := tryAcquireSHMLeader(dir)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: sharedMemory leader election: %v", err)
+	}
+	if acquired {
+		return serveSHMAggregate(c, dir, ttl, onError)
+	}
+
+	go runSHMLeaderElection(c, dir, ttl, onError)
+	return nil, nil
+}
+
+// runSHMLeaderElection retries acquiring dir/leader.lock until it succeeds,
+// then serves the merged aggregate for as long as this process holds the
+// lock (i.e. forever, since the lock is never voluntarily released). Any
+// error serving is reported via onError, since this runs in the
+// background with no caller left to return it to.
+func runSHMLeaderElection(c Configuration, dir string, ttl time.Duration, onError func(error)) {
+	ticker := time.NewTicker(shmLeaderRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := tryAcquireSHMLeader(dir)
+		if err != nil {
+			onError(fmt.Errorf("prometheus: sharedMemory leader election: %v", err))
+		} else if acquired {
+			if _, err := serveSHMAggregate(c, dir, ttl, onError); err != nil {
+				onError(err)
+			}
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// serveSHMAggregate registers the merged-aggregate handler, and - when
+// ListenAddress/DynamicListenAddress resolves - starts and returns the
+// *http.Server serving it, so the caller (directly, or via onError when
+// called from the background retry loop) can be notified of a listen
+// error and, in the synchronous case, later Shutdown(ctx) it.
+func serveSHMAggregate(c Configuration, dir string, ttl time.Duration, onError func(error)) (*http.Server, error) {
+	path := "/metrics"
+	if handlerPath := strings.TrimSpace(c.HandlerPath); handlerPath != "" {
+		path = handlerPath
+	}
+
+	handler, err := c.HandlerOptions.wrap(shmHandler(dir, ttl, onError))
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: sharedMemory handler: %v", err)
+	}
+
+	addr, resolved, err := c.resolveListenAddress()
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: sharedMemory listen address: %v", err)
+	}
+
+	if !resolved {
+		http.Handle(path, handler)
+		return nil, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	if err := c.wrapExtraHandlers(mux); err != nil {
+		return nil, fmt.Errorf("prometheus: sharedMemory extra handlers: %v", err)
+	}
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  c.ServerTimeouts.ReadTimeout,
+		WriteTimeout: c.ServerTimeouts.WriteTimeout,
+		IdleTimeout:  c.ServerTimeouts.IdleTimeout,
+	}
+
+	useTLS := c.HandlerOptions.TLS != nil
+	if useTLS {
+		tlsCfg, err := c.HandlerOptions.TLS.buildTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: sharedMemory TLS config: %v", err)
+		}
+		server.TLSConfig = tlsCfg
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(c.HandlerOptions.TLS.CertFile, c.HandlerOptions.TLS.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			onError(err)
+		}
+	}()
+
+	return server, nil
+}
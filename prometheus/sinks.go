@@ -0,0 +1,329 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	tally "github.com/uber-go/tally"
+)
+
+// NewReporterWithSinkOptions wraps reporter so that its timer/histogram
+// sinks are registered directly against the Prometheus registry with
+// native/exemplar support, instead of through reporter's own (opaque)
+// cached-sink implementation. opts is the same resolved Options passed to
+// NewReporter; its DefaultTimerType/DefaultHistogramBuckets/
+// DefaultSummaryObjectives are carried over so that wrapping a reporter
+// in sinkReporter doesn't silently change sinks that NativeHistogram and
+// Exemplars weren't even targeting. It is called by wrapSinkOptions after
+// NewReporter whenever NativeHistogram or Exemplars is configured, since
+// both require intercepting AllocateTimer/AllocateHistogram.
+func NewReporterWithSinkOptions(reporter Reporter, opts Options) (Reporter, error) {
+	g, ok := reporter.(gatherer)
+	if !ok {
+		return nil, fmt.Errorf("prometheus: nativeHistogram/exemplars require a reporter that exposes its registry")
+	}
+
+	var exemplarOpts ExemplarsOptions
+	if opts.Exemplars != nil {
+		exemplarOpts = *opts.Exemplars
+	}
+
+	return &sinkReporter{
+		Reporter:                 reporter,
+		registerer:               g.Registerer(),
+		native:                   opts.NativeHistogram,
+		exemplars:                exemplarOpts,
+		defaultTimerType:         opts.DefaultTimerType,
+		defaultHistogramBuckets:  opts.DefaultHistogramBuckets,
+		defaultSummaryObjectives: opts.DefaultSummaryObjectives,
+	}, nil
+}
+
+// sinkReporter decorates a Reporter, taking over timer/histogram
+// allocation so that NativeHistogramOptions and ExemplarsOptions can
+// actually affect how those sinks are registered and recorded against.
+// The default* fields mirror the Options a plain NewReporter would have
+// used, so that sinks NativeHistogram/Exemplars don't target keep the
+// same type/buckets/objectives they would have had unwrapped. Counters
+// and gauges are left to the embedded Reporter unchanged.
+type sinkReporter struct {
+	Reporter
+	registerer promclient.Registerer
+	native     *NativeHistogramOptions
+	exemplars  ExemplarsOptions
+
+	defaultTimerType         TimerType
+	defaultHistogramBuckets  []float64
+	defaultSummaryObjectives map[float64]float64
+
+	timers     sync.Map
+	histograms sync.Map
+}
+
+// Registerer satisfies the gatherer interface that RemoteWrite/Pushgateway/
+// SharedMemory type-assert for, which would otherwise not be promoted
+// through the embedded Reporter interface value.
+func (r *sinkReporter) Registerer() promclient.Registerer {
+	return r.registerer
+}
+
+// HTTPHandler overrides the embedded Reporter's handler to negotiate
+// OpenMetrics on scrape when native histograms or exemplars are
+// configured, since neither the sparse bucket representation nor
+// exemplars can be carried by the classic exposition format. It falls
+// back to Reporter.HTTPHandler() unchanged otherwise, including when the
+// registerer isn't also a Gatherer.
+func (r *sinkReporter) HTTPHandler() http.Handler {
+	if r.native == nil && r.exemplars.Extractor == nil {
+		return r.Reporter.HTTPHandler()
+	}
+
+	g, ok := r.registerer.(promclient.Gatherer)
+	if !ok {
+		return r.Reporter.HTTPHandler()
+	}
+
+	return promhttp.HandlerFor(g, handlerOpts())
+}
+
+func (r *sinkReporter) AllocateTimer(name string, tags map[string]string) tally.CachedTimer {
+	key := sinkCacheKey(name, tags)
+	if v, ok := r.timers.Load(key); ok {
+		return v.(*observerTimer)
+	}
+
+	observer, err := r.registerTimerObserver(name, tags)
+	if err != nil {
+		return r.Reporter.AllocateTimer(name, tags)
+	}
+
+	t := &observerTimer{observer: observer, exemplars: r.exemplars}
+	actual, _ := r.timers.LoadOrStore(key, t)
+	return actual.(*observerTimer)
+}
+
+// registerTimerObserver registers the same sink type Configuration.TimerType
+// would have produced through the plain (unwrapped) reporter: a Summary
+// when DefaultTimerType is SummaryTimerType, a Histogram otherwise.
+func (r *sinkReporter) registerTimerObserver(name string, tags map[string]string) (promclient.Observer, error) {
+	if r.defaultTimerType == SummaryTimerType {
+		return r.registerSummary(name, tags)
+	}
+	return r.registerHistogram(name, tags, nil)
+}
+
+// registerSummary registers (or reuses) a SummaryVec for name/tags, using
+// DefaultSummaryObjectives, and returns the Observer for this series.
+func (r *sinkReporter) registerSummary(name string, tags map[string]string) (promclient.Observer, error) {
+	vec := promclient.NewSummaryVec(promclient.SummaryOpts{
+		Name:       name,
+		Objectives: r.defaultSummaryObjectives,
+	}, labelNames(tags))
+	if err := r.registerer.Register(vec); err != nil {
+		are, ok := err.(promclient.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		vec = are.ExistingCollector.(*promclient.SummaryVec)
+	}
+
+	return vec.GetMetricWith(promclient.Labels(tags))
+}
+
+func (r *sinkReporter) AllocateHistogram(
+	name string, tags map[string]string, buckets tally.Buckets,
+) tally.CachedHistogram {
+	key := sinkCacheKey(name, tags)
+	if v, ok := r.histograms.Load(key); ok {
+		return v.(*observerHistogram)
+	}
+
+	var bounds []float64
+	if buckets != nil {
+		bounds = buckets.AsValues()
+	}
+	observer, err := r.registerHistogram(name, tags, bounds)
+	if err != nil {
+		return r.Reporter.AllocateHistogram(name, tags, buckets)
+	}
+
+	h := &observerHistogram{observer: observer, exemplars: r.exemplars}
+	actual, _ := r.histograms.LoadOrStore(key, h)
+	return actual.(*observerHistogram)
+}
+
+// registerHistogram registers (or reuses) a HistogramVec for name/tags,
+// falling back to defaultHistogramBuckets when the caller (a tally
+// Histogram with explicit buckets) didn't supply any of its own, applying
+// native.applyTo when native histograms are enabled for this metric, and
+// returns the Observer for this series.
+func (r *sinkReporter) registerHistogram(
+	name string, tags map[string]string, buckets []float64,
+) (promclient.Observer, error) {
+	if buckets == nil {
+		buckets = r.defaultHistogramBuckets
+	}
+
+	histOpts := promclient.HistogramOpts{Name: name, Buckets: buckets}
+	if r.native != nil && r.native.UseNativeHistogram(name) {
+		r.native.applyTo(&histOpts)
+	}
+
+	vec := promclient.NewHistogramVec(histOpts, labelNames(tags))
+	if err := r.registerer.Register(vec); err != nil {
+		are, ok := err.(promclient.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		vec = are.ExistingCollector.(*promclient.HistogramVec)
+	}
+
+	return vec.GetMetricWith(promclient.Labels(tags))
+}
+
+// sinkCacheKey must be deterministic across calls for the same name/tags
+// so that AllocateTimer/AllocateHistogram reuse a cached sink instead of
+// registering a duplicate HistogramVec each time map iteration happens to
+// order tags differently.
+func sinkCacheKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := name
+	for _, k := range keys {
+		key += "," + k + "=" + tags[k]
+	}
+	return key
+}
+
+// observerTimer adapts a promclient.Observer to tally.CachedTimer, and
+// additionally exposes RecordDurationContext for callers that bypass the
+// normal Scope.Timer().Record() path to attach an exemplar.
+type observerTimer struct {
+	observer  promclient.Observer
+	exemplars ExemplarsOptions
+}
+
+func (t *observerTimer) ReportTimer(interval time.Duration) {
+	t.observer.Observe(interval.Seconds())
+}
+
+// RecordDurationContext records d, attaching an exemplar derived from ctx
+// when Exemplars is configured and ctx is selected by its sample rate.
+func (t *observerTimer) RecordDurationContext(ctx context.Context, d time.Duration) {
+	observeWithExemplar(t.observer, t.exemplars, ctx, d.Seconds())
+}
+
+// observerHistogram adapts a promclient.Observer to tally.CachedHistogram,
+// recording each bucket's samples at a representative value (see
+// bucketMidpoint), and additionally exposes RecordValueContext for
+// exemplar-attaching callers.
+type observerHistogram struct {
+	observer  promclient.Observer
+	exemplars ExemplarsOptions
+}
+
+func (h *observerHistogram) ValueBucket(
+	bucketLowerBound, bucketUpperBound float64,
+) tally.CachedHistogramBucket {
+	return &observerHistogramBucket{
+		observer: h.observer,
+		value:    bucketMidpoint(bucketLowerBound, bucketUpperBound),
+	}
+}
+
+func (h *observerHistogram) DurationBucket(
+	bucketLowerBound, bucketUpperBound time.Duration,
+) tally.CachedHistogramBucket {
+	return &observerHistogramBucket{
+		observer: h.observer,
+		value:    bucketMidpoint(bucketLowerBound.Seconds(), bucketUpperBound.Seconds()),
+	}
+}
+
+// RecordValueContext records v, attaching an exemplar derived from ctx
+// when Exemplars is configured and ctx is selected by its sample rate.
+func (h *observerHistogram) RecordValueContext(ctx context.Context, v float64) {
+	observeWithExemplar(h.observer, h.exemplars, ctx, v)
+}
+
+type observerHistogramBucket struct {
+	observer promclient.Observer
+	value    float64
+}
+
+func (b *observerHistogramBucket) ReportSamples(value int64) {
+	for i := int64(0); i < value; i++ {
+		b.observer.Observe(b.value)
+	}
+}
+
+// bucketMidpoint picks a representative value for a histogram bucket.
+// Tally's lowest/highest buckets use -Inf/+Inf bounds; in those cases fall
+// back to the finite bound so the recorded value isn't NaN/Inf.
+func bucketMidpoint(lower, upper float64) float64 {
+	switch {
+	case math.IsInf(lower, -1):
+		return upper
+	case math.IsInf(upper, 1):
+		return lower
+	default:
+		return lower + (upper-lower)/2
+	}
+}
+
+// observeWithExemplar records v against observer, attaching an exemplar
+// derived from ctx when observer supports exemplars, Exemplars is
+// configured, and ctx is selected by its sample rate. It falls back to a
+// plain Observe in every other case, including when Exemplars isn't
+// configured at all.
+func observeWithExemplar(observer promclient.Observer, opts ExemplarsOptions, ctx context.Context, v float64) {
+	eo, ok := observer.(promclient.ExemplarObserver)
+	if !ok || opts.Extractor == nil || !shouldSampleExemplar(opts.SampleRate) {
+		observer.Observe(v)
+		return
+	}
+
+	labels := opts.Extractor(ctx)
+	if len(labels) == 0 {
+		observer.Observe(v)
+		return
+	}
+
+	eo.ObserveWithExemplar(v, labels)
+}
+
+func shouldSampleExemplar(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
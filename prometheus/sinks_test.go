@@ -0,0 +1,85 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSinkCacheKeyDeterministic(t *testing.T) {
+	tags := map[string]string{"b": "2", "a": "1", "c": "3"}
+
+	want := sinkCacheKey("requests", tags)
+	for i := 0; i < 10; i++ {
+		if got := sinkCacheKey("requests", tags); got != want {
+			t.Fatalf("sinkCacheKey(%q, %v) = %q, want %q (map iteration order must not affect the key)", "requests", tags, got, want)
+		}
+	}
+}
+
+func TestSinkCacheKeyDistinguishesNameAndTags(t *testing.T) {
+	base := sinkCacheKey("requests", map[string]string{"route": "/foo"})
+
+	cases := map[string]string{
+		"different name":  sinkCacheKey("errors", map[string]string{"route": "/foo"}),
+		"different value": sinkCacheKey("requests", map[string]string{"route": "/bar"}),
+		"different tag":   sinkCacheKey("requests", map[string]string{"method": "/foo"}),
+		"extra tag":       sinkCacheKey("requests", map[string]string{"route": "/foo", "method": "GET"}),
+	}
+
+	for name, got := range cases {
+		if got == base {
+			t.Errorf("%s: sinkCacheKey collided with base key %q", name, base)
+		}
+	}
+}
+
+func TestBucketMidpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		lower, upper float64
+		want         float64
+	}{
+		{name: "finite range", lower: 0, upper: 10, want: 5},
+		{name: "negative lower bound", lower: -10, upper: 0, want: -5},
+		{name: "lowest bucket uses upper bound", lower: math.Inf(-1), upper: 1, want: 1},
+		{name: "highest bucket uses lower bound", lower: 1, upper: math.Inf(1), want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketMidpoint(tt.lower, tt.upper); got != tt.want {
+				t.Errorf("bucketMidpoint(%v, %v) = %v, want %v", tt.lower, tt.upper, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketMidpointNeverNaNOrInf(t *testing.T) {
+	bounds := []float64{math.Inf(-1), -5, 0, 5, math.Inf(1)}
+	for i := 0; i < len(bounds)-1; i++ {
+		v := bucketMidpoint(bounds[i], bounds[i+1])
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("bucketMidpoint(%v, %v) = %v, want a finite value", bounds[i], bounds[i+1], v)
+		}
+	}
+}